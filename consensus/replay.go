@@ -1,7 +1,6 @@
 package consensus
 
 import (
-	"bytes"
 	"fmt"
 	"hash/crc32"
 	"io"
@@ -261,7 +260,10 @@ func (h *Handshaker) Handshake(proxyApp proxy.AppConns) error {
 
 	// Set AppVersion on the state.
 	if h.initialState.Version.Consensus.App != version.Protocol(res.AppVersion) {
-		h.initialState.Version.Consensus.App = version.Protocol(res.AppVersion)
+		h.initialState, err = h.initialState.WithAppVersion(res.AppVersion)
+		if err != nil {
+			return fmt.Errorf("error setting app version: %v", err)
+		}
 		sm.SaveState(h.stateDB, h.initialState)
 	}
 
@@ -488,24 +490,23 @@ func (h *Handshaker) replayBlock(state sm.State, height int64, proxyApp proxy.Ap
 }
 
 func assertAppHashEqualsOneFromBlock(appHash []byte, block *types.Block) {
-	if !bytes.Equal(appHash, block.AppHash) {
-		panic(fmt.Sprintf(`block.AppHash does not match AppHash after replay. Got %X, expected %X.
+	if err := sm.CompareAppHash(block.AppHash, appHash, block.Height-1); err != nil {
+		panic(fmt.Sprintf(`block.AppHash does not match AppHash after replay: %v
 
 Block: %v
 `,
-			appHash, block.AppHash, block))
+			err, block))
 	}
 }
 
 func assertAppHashEqualsOneFromState(appHash []byte, state sm.State) {
-	if !bytes.Equal(appHash, state.AppHash) {
-		panic(fmt.Sprintf(`state.AppHash does not match AppHash after replay. Got
-%X, expected %X.
+	if err := sm.CompareAppHash(state.AppHash, appHash, state.LastBlockHeight); err != nil {
+		panic(fmt.Sprintf(`state.AppHash does not match AppHash after replay: %v
 
 State: %v
 
 Did you reset Tendermint without resetting your application's data?`,
-			appHash, state.AppHash, state))
+			err, state))
 	}
 }
 
@@ -1186,3 +1186,61 @@ func (ica *initChainApp) InitChain(req abci.RequestInitChain) abci.ResponseInitC
 		Validators: ica.vals,
 	}
 }
+
+func TestHandshakeAppVersion(t *testing.T) {
+	testCases := []struct {
+		name          string
+		stateVersion  version.Protocol
+		appVersion    uint64
+		expectVersion version.Protocol
+		expectErr     bool
+	}{
+		{"unset", 0, 1, 1, false},
+		{"unchanged", 2, 2, 2, false},
+		{"upgrade", 2, 3, 3, false},
+		{"downgrade", 2, 1, 2, true},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			app := &appVersionApp{appVersion: tc.appVersion}
+			clientCreator := proxy.NewLocalClientCreator(app)
+
+			config := ResetConfig("handshake_test_")
+			defer os.RemoveAll(config.RootDir)
+			privVal := privval.LoadFilePV(config.PrivValidatorKeyFile(), config.PrivValidatorStateFile())
+			pubKey, err := privVal.GetPubKey()
+			require.NoError(t, err)
+			stateDB, state, store := stateAndStore(config, pubKey, tc.stateVersion)
+
+			genDoc, _ := sm.MakeGenesisDocFromFile(config.GenesisFile())
+			handshaker := NewHandshaker(stateDB, state, store, genDoc)
+			proxyApp := proxy.NewAppConns(clientCreator)
+			require.NoError(t, proxyApp.Start())
+			defer proxyApp.Stop()
+
+			err = handshaker.Handshake(proxyApp)
+			if tc.expectErr {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), "lower than the current app version")
+			} else {
+				require.NoError(t, err)
+			}
+
+			// a downgrade must not be persisted
+			state = sm.LoadState(stateDB)
+			assert.Equal(t, tc.expectVersion, state.Version.Consensus.App)
+		})
+	}
+}
+
+// returns the app version on Info
+type appVersionApp struct {
+	abci.BaseApplication
+	appVersion uint64
+}
+
+func (app *appVersionApp) Info(req abci.RequestInfo) abci.ResponseInfo {
+	return abci.ResponseInfo{AppVersion: app.appVersion}
+}
@@ -337,9 +337,10 @@ func state(nVals int, height int64) (sm.State, dbm.DB) {
 		}
 	}
 	s, _ := sm.MakeGenesisState(&types.GenesisDoc{
-		ChainID:    "test-chain",
-		Validators: vals,
-		AppHash:    nil,
+		GenesisTime: tmtime.Now(),
+		ChainID:     "test-chain",
+		Validators:  vals,
+		AppHash:     nil,
 	})
 
 	// save validators to db for 2 heights
@@ -0,0 +1,55 @@
+package state
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/tendermint/tendermint/crypto/tmhash"
+)
+
+// ExportBundle serializes the State into a portable bundle which can be used
+// to bootstrap a node at the state's height without the rest of the database.
+// The State carries everything needed to resume: the last block info, the app
+// hash, the validator sets and the consensus params.
+//
+// The bundle is the versioned encoding of the State (see MarshalVersioned)
+// followed by a checksum:
+//
+//	MarshalVersioned() | checksum (tmhash of the preceding bytes)
+func (state State) ExportBundle() ([]byte, error) {
+	if state.IsEmpty() {
+		return nil, errors.New("can't export an empty state")
+	}
+	if err := state.ValidateBasic(); err != nil {
+		return nil, fmt.Errorf("can't export an invalid state: %w", err)
+	}
+
+	bz := state.MarshalVersioned()
+	return append(bz, tmhash.Sum(bz)...), nil
+}
+
+// ImportBundle decodes and validates a bundle produced by ExportBundle.
+func ImportBundle(bundle []byte) (State, error) {
+	if len(bundle) < 1+tmhash.Size {
+		return State{}, fmt.Errorf("state bundle is too short (%d bytes)", len(bundle))
+	}
+
+	bz, checksum := bundle[:len(bundle)-tmhash.Size], bundle[len(bundle)-tmhash.Size:]
+	if !bytes.Equal(checksum, tmhash.Sum(bz)) {
+		return State{}, errors.New("state bundle checksum mismatch")
+	}
+
+	state, err := UnmarshalVersioned(bz)
+	if err != nil {
+		return State{}, fmt.Errorf("can't decode state bundle: %w", err)
+	}
+	if state.IsEmpty() {
+		return State{}, errors.New("state bundle contains an empty state")
+	}
+	if err := state.ValidateBasic(); err != nil {
+		return State{}, fmt.Errorf("state bundle contains an invalid state: %w", err)
+	}
+
+	return state, nil
+}
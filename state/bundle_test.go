@@ -0,0 +1,64 @@
+package state_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tendermint/tendermint/crypto/tmhash"
+	tmrand "github.com/tendermint/tendermint/libs/rand"
+	sm "github.com/tendermint/tendermint/state"
+	"github.com/tendermint/tendermint/types"
+)
+
+func TestStateBundleRoundTrip(t *testing.T) {
+	state, _, _ := makeState(3, 5)
+	state.LastBlockID = types.BlockID{
+		Hash:        tmrand.Bytes(tmhash.Size),
+		PartsHeader: types.PartSetHeader{Total: 1, Hash: tmrand.Bytes(tmhash.Size)},
+	}
+	state.AppHash = []byte("app_hash")
+	state.LastResultsHash = tmrand.Bytes(tmhash.Size)
+
+	bundle, err := state.ExportBundle()
+	require.NoError(t, err)
+
+	imported, err := sm.ImportBundle(bundle)
+	require.NoError(t, err)
+	assert.True(t, state.Equals(imported))
+}
+
+func TestStateBundleRejectsCorrupted(t *testing.T) {
+	state, _, _ := makeState(3, 1)
+	bundle, err := state.ExportBundle()
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name    string
+		corrupt func(bz []byte) []byte
+	}{
+		{"empty", func(bz []byte) []byte { return nil }},
+		{"truncated", func(bz []byte) []byte { return bz[:len(bz)-1] }},
+		{"unknown version", func(bz []byte) []byte { bz[0]++; return bz }},
+		{"unknown version with valid checksum", func(bz []byte) []byte {
+			payload := bz[:len(bz)-tmhash.Size]
+			payload[0]++
+			return append(payload, tmhash.Sum(payload)...)
+		}},
+		{"flipped payload byte", func(bz []byte) []byte { bz[len(bz)/2] ^= 0xFF; return bz }},
+		{"flipped checksum byte", func(bz []byte) []byte { bz[len(bz)-1] ^= 0xFF; return bz }},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			bz := tc.corrupt(append([]byte{}, bundle...))
+			_, err := sm.ImportBundle(bz)
+			assert.Error(t, err)
+		})
+	}
+
+	_, err = sm.State{}.ExportBundle()
+	assert.Error(t, err)
+}
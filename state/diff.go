@@ -0,0 +1,191 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/tendermint/tendermint/types"
+)
+
+// Fields of the State which can be part of a diff.
+const (
+	diffVersion uint32 = 1 << iota
+	diffChainID
+	diffInitialHeight
+	diffLastBlockHeight
+	diffLastBlockID
+	diffLastBlockTime
+	diffNextValidators
+	diffValidators
+	diffLastValidators
+	diffLastHeightValidatorsChanged
+	diffConsensusParams
+	diffLastHeightConsensusParamsChanged
+	diffLastResultsHash
+	diffAppHash
+	diffPendingConsensusParams
+
+	diffAll = diffPendingConsensusParams<<1 - 1
+)
+
+// stateDiff is the encoded form of a diff: the fields of State set in Changed
+// are taken from Fields, all others are left as zero values so amino omits
+// them.
+type stateDiff struct {
+	Changed uint32
+	Fields  State
+}
+
+// StateDiff encodes the fields of newState which differ from old. Between two
+// consecutive heights, usually only the heights, the last block info and the
+// hashes change, so the diff is much smaller than the State; validator sets are
+// included only if they changed, proposer priorities included. Applying the
+// diff to old with ApplyStateDiff gives back newState.
+func StateDiff(old, newState State) ([]byte, error) {
+	var d stateDiff
+	set := func(field uint32, changed bool) bool {
+		if changed {
+			d.Changed |= field
+		}
+		return changed
+	}
+
+	if set(diffVersion, old.Version != newState.Version) {
+		d.Fields.Version = newState.Version
+	}
+	if set(diffChainID, old.ChainID != newState.ChainID) {
+		d.Fields.ChainID = newState.ChainID
+	}
+	if set(diffInitialHeight, old.InitialHeight != newState.InitialHeight) {
+		d.Fields.InitialHeight = newState.InitialHeight
+	}
+	if set(diffLastBlockHeight, old.LastBlockHeight != newState.LastBlockHeight) {
+		d.Fields.LastBlockHeight = newState.LastBlockHeight
+	}
+	if set(diffLastBlockID, !old.LastBlockID.Equals(newState.LastBlockID)) {
+		d.Fields.LastBlockID = newState.LastBlockID
+	}
+	if set(diffLastBlockTime, !old.LastBlockTime.Equal(newState.LastBlockTime)) {
+		d.Fields.LastBlockTime = newState.LastBlockTime
+	}
+	if set(diffNextValidators, !valSetsEqual(old.NextValidators, newState.NextValidators)) {
+		d.Fields.NextValidators = newState.NextValidators
+	}
+	if set(diffValidators, !valSetsEqual(old.Validators, newState.Validators)) {
+		d.Fields.Validators = newState.Validators
+	}
+	if set(diffLastValidators, !valSetsEqual(old.LastValidators, newState.LastValidators)) {
+		d.Fields.LastValidators = newState.LastValidators
+	}
+	if set(diffLastHeightValidatorsChanged,
+		old.LastHeightValidatorsChanged != newState.LastHeightValidatorsChanged) {
+		d.Fields.LastHeightValidatorsChanged = newState.LastHeightValidatorsChanged
+	}
+	if set(diffConsensusParams, !old.ConsensusParams.Equals(&newState.ConsensusParams)) {
+		d.Fields.ConsensusParams = newState.ConsensusParams
+	}
+	if set(diffLastHeightConsensusParamsChanged,
+		old.LastHeightConsensusParamsChanged != newState.LastHeightConsensusParamsChanged) {
+		d.Fields.LastHeightConsensusParamsChanged = newState.LastHeightConsensusParamsChanged
+	}
+	if set(diffLastResultsHash, !bytes.Equal(old.LastResultsHash, newState.LastResultsHash)) {
+		d.Fields.LastResultsHash = newState.LastResultsHash
+	}
+	if set(diffAppHash, !bytes.Equal(old.AppHash, newState.AppHash)) {
+		d.Fields.AppHash = newState.AppHash
+	}
+	if set(diffPendingConsensusParams,
+		!pendingConsensusParamsEqual(old.PendingConsensusParams, newState.PendingConsensusParams)) {
+		d.Fields.PendingConsensusParams = newState.PendingConsensusParams
+	}
+
+	bz, err := cdc.MarshalBinaryBare(d)
+	if err != nil {
+		return nil, fmt.Errorf("can't encode state diff: %w", err)
+	}
+	return bz, nil
+}
+
+// ApplyStateDiff applies a diff produced by StateDiff to old, which must be
+// the State the diff was computed from. old is not modified.
+func ApplyStateDiff(old State, diff []byte) (State, error) {
+	var d stateDiff
+	if err := cdc.UnmarshalBinaryBare(diff, &d); err != nil {
+		return State{}, fmt.Errorf("can't decode state diff: %w", err)
+	}
+	if d.Changed&^diffAll != 0 {
+		return State{}, fmt.Errorf("state diff has unknown fields %b", d.Changed&^diffAll)
+	}
+
+	state := old.Copy()
+	changed := func(field uint32) bool { return d.Changed&field != 0 }
+
+	if changed(diffVersion) {
+		state.Version = d.Fields.Version
+	}
+	if changed(diffChainID) {
+		state.ChainID = d.Fields.ChainID
+	}
+	if changed(diffInitialHeight) {
+		state.InitialHeight = d.Fields.InitialHeight
+	}
+	if changed(diffLastBlockHeight) {
+		state.LastBlockHeight = d.Fields.LastBlockHeight
+	}
+	if changed(diffLastBlockID) {
+		state.LastBlockID = d.Fields.LastBlockID
+	}
+	if changed(diffLastBlockTime) {
+		state.LastBlockTime = d.Fields.LastBlockTime
+	}
+	if changed(diffNextValidators) {
+		state.NextValidators = d.Fields.NextValidators
+	}
+	if changed(diffValidators) {
+		state.Validators = d.Fields.Validators
+	}
+	if changed(diffLastValidators) {
+		state.LastValidators = d.Fields.LastValidators
+	}
+	if changed(diffLastHeightValidatorsChanged) {
+		state.LastHeightValidatorsChanged = d.Fields.LastHeightValidatorsChanged
+	}
+	if changed(diffConsensusParams) {
+		state.ConsensusParams = d.Fields.ConsensusParams
+	}
+	if changed(diffLastHeightConsensusParamsChanged) {
+		state.LastHeightConsensusParamsChanged = d.Fields.LastHeightConsensusParamsChanged
+	}
+	if changed(diffLastResultsHash) {
+		state.LastResultsHash = d.Fields.LastResultsHash
+	}
+	if changed(diffAppHash) {
+		state.AppHash = d.Fields.AppHash
+	}
+	if changed(diffPendingConsensusParams) {
+		state.PendingConsensusParams = d.Fields.PendingConsensusParams
+	}
+
+	return state, nil
+}
+
+// valSetsEqual returns true if both validator sets have the same encoding,
+// which includes the proposer priorities.
+func valSetsEqual(vals1, vals2 *types.ValidatorSet) bool {
+	if vals1 == nil || vals2 == nil {
+		return vals1 == vals2
+	}
+	return bytes.Equal(cdc.MustMarshalBinaryBare(vals1), cdc.MustMarshalBinaryBare(vals2))
+}
+
+func pendingConsensusParamsEqual(pending1, pending2 []ScheduledConsensusParams) bool {
+	if len(pending1) != len(pending2) {
+		return false
+	}
+	for i := range pending1 {
+		if pending1[i].Height != pending2[i].Height || !pending1[i].Update.Equal(pending2[i].Update) {
+			return false
+		}
+	}
+	return true
+}
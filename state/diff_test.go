@@ -0,0 +1,90 @@
+package state_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	abci "github.com/tendermint/tendermint/abci/types"
+	"github.com/tendermint/tendermint/crypto/tmhash"
+	tmrand "github.com/tendermint/tendermint/libs/rand"
+	sm "github.com/tendermint/tendermint/state"
+	"github.com/tendermint/tendermint/types"
+)
+
+func TestStateDiffMinimalChange(t *testing.T) {
+	old, _, _ := makeState(4, 5)
+	newState := old.Copy()
+	newState.LastBlockHeight++
+	newState.LastBlockID = types.BlockID{
+		Hash:        tmrand.Bytes(tmhash.Size),
+		PartsHeader: types.PartSetHeader{Total: 1, Hash: tmrand.Bytes(tmhash.Size)},
+	}
+	newState.LastBlockTime = old.LastBlockTime.Add(1)
+	newState.AppHash = tmrand.Bytes(tmhash.Size)
+	newState.LastResultsHash = tmrand.Bytes(tmhash.Size)
+
+	diff, err := sm.StateDiff(old, newState)
+	require.NoError(t, err)
+	assert.Less(t, len(diff), len(newState.Bytes())/2)
+
+	applied, err := sm.ApplyStateDiff(old, diff)
+	require.NoError(t, err)
+	assert.True(t, newState.Equals(applied))
+	// old is not modified
+	assert.NotEqual(t, newState.LastBlockHeight, old.LastBlockHeight)
+
+	// an empty diff gives back the old state
+	diff, err = sm.StateDiff(old, old)
+	require.NoError(t, err)
+	applied, err = sm.ApplyStateDiff(old, diff)
+	require.NoError(t, err)
+	assert.True(t, old.Equals(applied))
+}
+
+func TestStateDiffValidatorSetChange(t *testing.T) {
+	old, _, _ := makeState(4, 5)
+	newState := old.Copy()
+	newState.LastBlockHeight++
+	newState.LastValidators = old.Validators.Copy()
+	newState.Validators = old.NextValidators.Copy()
+	newState.NextValidators = genValSet(5)
+	newState.LastHeightValidatorsChanged = newState.LastBlockHeight + 2
+
+	diff, err := sm.StateDiff(old, newState)
+	require.NoError(t, err)
+	applied, err := sm.ApplyStateDiff(old, diff)
+	require.NoError(t, err)
+	assert.True(t, newState.Equals(applied))
+
+	// only a proposer priority change is enough
+	newState = old.Copy()
+	newState.Validators.IncrementProposerPriority(1)
+	diff, err = sm.StateDiff(old, newState)
+	require.NoError(t, err)
+	applied, err = sm.ApplyStateDiff(old, diff)
+	require.NoError(t, err)
+	assert.True(t, newState.Equals(applied))
+	assert.False(t, old.Equals(applied))
+}
+
+func TestApplyStateDiffInvalid(t *testing.T) {
+	old, _, _ := makeState(1, 1)
+	_, err := sm.ApplyStateDiff(old, []byte{0xFF, 0xFF})
+	assert.Error(t, err)
+}
+
+func TestStateDiffPendingConsensusParams(t *testing.T) {
+	old, _, _ := makeState(1, 1)
+	update := &abci.ConsensusParams{Block: &abci.BlockParams{MaxBytes: 1024, MaxGas: -1}}
+	newState, err := old.ScheduleConsensusParams(old.LastBlockHeight+5, update)
+	require.NoError(t, err)
+
+	diff, err := sm.StateDiff(old, newState)
+	require.NoError(t, err)
+	applied, err := sm.ApplyStateDiff(old, diff)
+	require.NoError(t, err)
+	assert.True(t, newState.Equals(applied))
+	assert.Equal(t, newState.PendingConsensusParams, applied.PendingConsensusParams)
+}
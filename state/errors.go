@@ -37,6 +37,17 @@ type (
 		Expected *State
 	}
 
+	ErrInvalidVersion struct {
+		Version Version
+		Reason  string
+	}
+
+	ErrAppHashMismatch struct {
+		Height   int64
+		Expected []byte
+		Actual   []byte
+	}
+
 	ErrNoValSetForHeight struct {
 		Height int64
 	}
@@ -88,6 +99,27 @@ func (e ErrStateMismatch) Error() string {
 	)
 }
 
+func (e ErrInvalidVersion) Error() string {
+	return fmt.Sprintf(
+		"invalid state version (block=%d, app=%d, software=%q): %s",
+		e.Version.Consensus.Block,
+		e.Version.Consensus.App,
+		e.Version.Software,
+		e.Reason,
+	)
+}
+
+func (e ErrAppHashMismatch) Error() string {
+	return fmt.Sprintf(
+		"app hash mismatch at height %d: expected %X (%d bytes), got %X (%d bytes)",
+		e.Height,
+		e.Expected,
+		len(e.Expected),
+		e.Actual,
+		len(e.Actual),
+	)
+}
+
 func (e ErrNoValSetForHeight) Error() string {
 	return fmt.Sprintf("could not find validator set for height #%d", e.Height)
 }
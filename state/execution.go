@@ -161,10 +161,16 @@ func (blockExec *BlockExecutor) ApplyBlock(
 	}
 
 	// Update the state with the block and responses.
+	prevNextVals := state.NextValidators
 	state, err = updateState(state, blockID, &block.Header, abciResponses, validatorUpdates)
 	if err != nil {
 		return state, 0, fmt.Errorf("commit failed for application: %v", err)
 	}
+	if len(validatorUpdates) > 0 {
+		added, removed, changed := ValidatorPowerDelta(prevNextVals, state.NextValidators)
+		blockExec.logger.Info("Voting power delta",
+			"height", block.Height, "added", added, "removed", removed, "changed", changed)
+	}
 
 	// Lock mempool, commit app state, update mempoool.
 	appHash, retainHeight, err := blockExec.Commit(state, block, abciResponses.DeliverTxs)
@@ -382,6 +388,37 @@ func validateValidatorUpdates(abciUpdates []abci.ValidatorUpdate,
 	return nil
 }
 
+// ValidatorPowerDelta returns the voting power which entered and left the
+// validator set between prev and next: added is the power of validators only
+// in next, removed the power of validators only in prev, and changed the sum of
+// the absolute power changes of validators in both.
+func ValidatorPowerDelta(prev, next *types.ValidatorSet) (added, removed, changed int64) {
+	if prev == nil {
+		prev = types.NewValidatorSet(nil)
+	}
+	if next == nil {
+		next = types.NewValidatorSet(nil)
+	}
+
+	for _, val := range prev.Validators {
+		if !next.HasAddress(val.Address) {
+			removed += val.VotingPower
+		}
+	}
+	for _, val := range next.Validators {
+		_, prevVal := prev.GetByAddress(val.Address)
+		switch {
+		case prevVal == nil:
+			added += val.VotingPower
+		case prevVal.VotingPower > val.VotingPower:
+			changed += prevVal.VotingPower - val.VotingPower
+		default:
+			changed += val.VotingPower - prevVal.VotingPower
+		}
+	}
+	return added, removed, changed
+}
+
 // updateState returns a new State updated according to the header and responses.
 func updateState(
 	state State,
@@ -402,6 +439,12 @@ func updateState(
 		if err != nil {
 			return state, fmt.Errorf("error changing validator set: %v", err)
 		}
+		if nValSet.Size() > MaxValidators {
+			return state, fmt.Errorf("error changing validator set: %d validators exceeds the maximum of %d",
+				nValSet.Size(),
+				MaxValidators,
+			)
+		}
 		// Change results from this height but only applies to the next next height.
 		lastHeightValsChanged = header.Height + 1 + 1
 	}
@@ -410,17 +453,23 @@ func updateState(
 	nValSet.IncrementProposerPriority(1)
 
 	// Update the params with the latest abciResponses.
-	nextParams := state.ConsensusParams
-	lastHeightParamsChanged := state.LastHeightConsensusParamsChanged
-	if abciResponses.EndBlock.ConsensusParamUpdates != nil {
-		// NOTE: must not mutate s.ConsensusParams
-		nextParams = state.ConsensusParams.Update(abciResponses.EndBlock.ConsensusParamUpdates)
-		err := nextParams.Validate()
-		if err != nil {
-			return state, fmt.Errorf("error updating consensus params: %v", err)
+	nextParams, lastHeightParamsChanged, err := state.ApplyConsensusParamUpdate(
+		abciResponses.EndBlock.ConsensusParamUpdates, header.Height)
+	if err != nil {
+		return state, err
+	}
+
+	// Scheduled params take effect at their height, on top of any update from
+	// EndBlock.
+	pendingParams := state.PendingConsensusParams
+	if len(pendingParams) > 0 && pendingParams[0].Height == header.Height+1 {
+		nextParams = nextParams.Update(pendingParams[0].Update)
+		if err := nextParams.Validate(); err != nil {
+			return state, fmt.Errorf("error applying consensus params scheduled at height %d: %v",
+				pendingParams[0].Height, err)
 		}
-		// Change results from this height but only applies to the next height.
-		lastHeightParamsChanged = header.Height + 1
+		lastHeightParamsChanged = pendingParams[0].Height
+		pendingParams = pendingParams[1:]
 	}
 
 	// TODO: allow app to upgrade version
@@ -442,6 +491,8 @@ func updateState(
 		LastHeightConsensusParamsChanged: lastHeightParamsChanged,
 		LastResultsHash:                  abciResponses.ResultsHash(),
 		AppHash:                          nil,
+		InitialHeight:                    state.InitialHeight,
+		PendingConsensusParams:           copyPendingConsensusParams(pendingParams),
 	}, nil
 }
 
@@ -318,6 +318,36 @@ func TestUpdateValidators(t *testing.T) {
 	}
 }
 
+func TestValidatorPowerDelta(t *testing.T) {
+	val1 := types.NewValidator(ed25519.GenPrivKey().PubKey(), 10)
+	val2 := types.NewValidator(ed25519.GenPrivKey().PubKey(), 20)
+	val3 := types.NewValidator(ed25519.GenPrivKey().PubKey(), 30)
+	val4 := types.NewValidator(ed25519.GenPrivKey().PubKey(), 40)
+
+	// val1 is removed, val2 gains 5, val3 loses 10 and val4 is added
+	prev := types.NewValidatorSet([]*types.Validator{val1, val2, val3})
+	next := types.NewValidatorSet([]*types.Validator{
+		types.NewValidator(val2.PubKey, 25),
+		types.NewValidator(val3.PubKey, 20),
+		val4,
+	})
+
+	added, removed, changed := sm.ValidatorPowerDelta(prev, next)
+	assert.EqualValues(t, 40, added)
+	assert.EqualValues(t, 10, removed)
+	assert.EqualValues(t, 15, changed)
+
+	added, removed, changed = sm.ValidatorPowerDelta(prev, prev)
+	assert.Zero(t, added)
+	assert.Zero(t, removed)
+	assert.Zero(t, changed)
+
+	added, removed, changed = sm.ValidatorPowerDelta(nil, prev)
+	assert.EqualValues(t, 60, added)
+	assert.Zero(t, removed)
+	assert.Zero(t, changed)
+}
+
 // TestEndBlockValidatorUpdates ensures we update validator set and send an event.
 func TestEndBlockValidatorUpdates(t *testing.T) {
 	app := &testApp{}
@@ -115,9 +115,10 @@ func makeState(nVals, height int) (sm.State, dbm.DB, map[string]types.PrivValida
 		privVals[valAddr.String()] = types.NewMockPVWithParams(pk, false, false)
 	}
 	s, _ := sm.MakeGenesisState(&types.GenesisDoc{
-		ChainID:    chainID,
-		Validators: vals,
-		AppHash:    nil,
+		GenesisTime: tmtime.Now(),
+		ChainID:     chainID,
+		Validators:  vals,
+		AppHash:     nil,
 	})
 
 	stateDB := dbm.NewMemDB()
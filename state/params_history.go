@@ -0,0 +1,61 @@
+package state
+
+import (
+	"sort"
+
+	"github.com/tendermint/tendermint/types"
+)
+
+// ConsensusParamsHistory records the consensus params in effect across
+// heights. Like LastHeightConsensusParamsChanged, it follows a sparse model:
+// params recorded at a height stay in effect until the next recorded change.
+// NOTE: not goroutine-safe.
+type ConsensusParamsHistory struct {
+	changes []paramsChange // sorted by height
+}
+
+type paramsChange struct {
+	height int64
+	params types.ConsensusParams
+}
+
+// Record records a copy of params as in effect from the given height on.
+// Recording at an already recorded height replaces the params for that height.
+func (h *ConsensusParamsHistory) Record(height int64, params types.ConsensusParams) {
+	i := h.search(height)
+	if i < len(h.changes) && h.changes[i].height == height {
+		h.changes[i].params = copyConsensusParams(params)
+		return
+	}
+	h.changes = append(h.changes, paramsChange{})
+	copy(h.changes[i+1:], h.changes[i:])
+	h.changes[i] = paramsChange{height: height, params: copyConsensusParams(params)}
+}
+
+// At returns the consensus params in effect at the given height, i.e. the
+// params of the last change recorded at or below it. The returned params are a
+// copy, so they can be mutated without changing the history. It returns
+// ErrNoConsensusParamsForHeight if the height is before the first change.
+func (h *ConsensusParamsHistory) At(height int64) (types.ConsensusParams, error) {
+	i := h.search(height + 1)
+	if i == 0 {
+		return types.ConsensusParams{}, ErrNoConsensusParamsForHeight{height}
+	}
+	return copyConsensusParams(h.changes[i-1].params), nil
+}
+
+// search returns the index of the first change at or above the given height.
+func (h *ConsensusParamsHistory) search(height int64) int {
+	return sort.Search(len(h.changes), func(i int) bool {
+		return h.changes[i].height >= height
+	})
+}
+
+// copyConsensusParams returns a copy of params which doesn't share the
+// Validator.PubKeyTypes slice.
+func copyConsensusParams(params types.ConsensusParams) types.ConsensusParams {
+	if params.Validator.PubKeyTypes != nil {
+		params.Validator.PubKeyTypes = append([]string{}, params.Validator.PubKeyTypes...)
+	}
+	return params
+}
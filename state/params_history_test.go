@@ -0,0 +1,75 @@
+package state_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	sm "github.com/tendermint/tendermint/state"
+	"github.com/tendermint/tendermint/types"
+)
+
+func TestConsensusParamsHistory(t *testing.T) {
+	params1 := makeConsensusParams(1, 2, 3, 4)
+	params2 := makeConsensusParams(10, 20, 30, 40)
+	params3 := makeConsensusParams(100, 200, 300, 400)
+
+	var history sm.ConsensusParamsHistory
+	// recorded out of order on purpose
+	history.Record(10, params2)
+	history.Record(1, params1)
+	history.Record(20, params3)
+
+	cases := []struct {
+		height   int64
+		expected types.ConsensusParams
+	}{
+		{1, params1},
+		{9, params1},
+		{10, params2},
+		{19, params2},
+		{20, params3},
+		{1000, params3},
+	}
+	for _, tc := range cases {
+		params, err := history.At(tc.height)
+		require.NoError(t, err, "height %d", tc.height)
+		assert.Equal(t, tc.expected, params, "height %d", tc.height)
+	}
+
+	// before the first change
+	_, err := history.At(0)
+	assert.Equal(t, sm.ErrNoConsensusParamsForHeight{Height: 0}, err)
+
+	// recording at the same height replaces the params
+	history.Record(10, params3)
+	params, err := history.At(15)
+	require.NoError(t, err)
+	assert.Equal(t, params3, params)
+}
+
+func TestConsensusParamsHistoryEmpty(t *testing.T) {
+	var history sm.ConsensusParamsHistory
+	_, err := history.At(1)
+	assert.Error(t, err)
+}
+
+func TestConsensusParamsHistoryCopies(t *testing.T) {
+	params := *types.DefaultConsensusParams()
+
+	var history sm.ConsensusParamsHistory
+	history.Record(1, params)
+
+	// mutating the recorded params doesn't change the history
+	params.Validator.PubKeyTypes[0] = "mutated"
+	recorded, err := history.At(1)
+	require.NoError(t, err)
+	assert.Equal(t, types.ABCIPubKeyTypeEd25519, recorded.Validator.PubKeyTypes[0])
+
+	// nor does mutating the returned params
+	recorded.Validator.PubKeyTypes[0] = "mutated"
+	recorded, err = history.At(1)
+	require.NoError(t, err)
+	assert.Equal(t, types.ABCIPubKeyTypeEd25519, recorded.Validator.PubKeyTypes[0])
+}
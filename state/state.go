@@ -2,10 +2,17 @@ package state
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"regexp"
+	"sort"
+	"sync"
 	"time"
 
+	abci "github.com/tendermint/tendermint/abci/types"
+	"github.com/tendermint/tendermint/crypto/tmhash"
+	tmbytes "github.com/tendermint/tendermint/libs/bytes"
 	"github.com/tendermint/tendermint/types"
 	tmtime "github.com/tendermint/tendermint/types/time"
 	"github.com/tendermint/tendermint/version"
@@ -39,6 +46,16 @@ var initStateVersion = Version{
 	Software: version.TMCoreSemVer,
 }
 
+// MaxValidators is the maximum size of a validator set. It isn't a consensus
+// param: it's the limit implied by types.MaxVotesCount, since a larger set
+// couldn't sign a valid commit.
+const MaxValidators = types.MaxVotesCount
+
+// softwareVersionPattern matches a semantic version, optionally prefixed with
+// "v" and followed by pre-release and build metadata, e.g. "0.34.0-rc4".
+var softwareVersionPattern = regexp.MustCompile(
+	`^v?[0-9]+\.[0-9]+\.[0-9]+(-[0-9A-Za-z.-]+)?(\+[0-9A-Za-z.-]+)?$`)
+
 //-----------------------------------------------------------------------------
 
 // State is a short description of the latest committed block of the Tendermint consensus.
@@ -80,6 +97,23 @@ type State struct {
 
 	// the latest AppHash we've received from calling abci.Commit()
 	AppHash []byte
+
+	// InitialHeight is the height of the first block of the chain.
+	// NOTE: it's the last field so States stored before it was added can
+	// still be decoded; loadState sets it to 1 for those.
+	InitialHeight int64
+
+	// Consensus params scheduled to take effect at future heights, ordered by
+	// height. See ScheduleConsensusParams.
+	PendingConsensusParams []ScheduledConsensusParams
+}
+
+// ScheduledConsensusParams is a consensus param update taking effect at
+// Height. Like the ConsensusParamUpdates returned by EndBlock, only the set
+// fields of Update are applied, on top of the params in effect at the time.
+type ScheduledConsensusParams struct {
+	Height int64
+	Update *abci.ConsensusParams
 }
 
 // Copy makes a copy of the State for mutating.
@@ -103,10 +137,168 @@ func (state State) Copy() State {
 		AppHash: state.AppHash,
 
 		LastResultsHash: state.LastResultsHash,
+
+		InitialHeight: state.InitialHeight,
+
+		PendingConsensusParams: copyPendingConsensusParams(state.PendingConsensusParams),
+	}
+}
+
+// CopyPtr is like Copy, but returns a pointer to a heap-allocated copy. It
+// avoids copying the (large) State struct by value through call frames.
+func (state *State) CopyPtr() *State {
+	if state == nil {
+		return nil
+	}
+	newState := new(State)
+	*newState = *state
+	newState.NextValidators = state.NextValidators.Copy()
+	newState.Validators = state.Validators.Copy()
+	newState.LastValidators = state.LastValidators.Copy()
+	newState.PendingConsensusParams = copyPendingConsensusParams(state.PendingConsensusParams)
+	return newState
+}
+
+func copyPendingConsensusParams(pending []ScheduledConsensusParams) []ScheduledConsensusParams {
+	if len(pending) == 0 {
+		return nil
+	}
+	return append([]ScheduledConsensusParams{}, pending...)
+}
+
+// WithAppVersion returns a copy of the State with Version.Consensus.App set to
+// the given app protocol version, as reported by the app during the Handshake.
+// It returns an error if the version is lower than the current one.
+func (state State) WithAppVersion(appVersion uint64) (State, error) {
+	if version.Protocol(appVersion) < state.Version.Consensus.App {
+		return state, fmt.Errorf("app version %d is lower than the current app version %d",
+			appVersion,
+			state.Version.Consensus.App,
+		)
 	}
+	newState := state.Copy()
+	newState.Version.Consensus.App = version.Protocol(appVersion)
+	return newState, nil
+}
+
+// WithResultsHash returns a copy of the State with LastResultsHash set to the
+// given hash (see ComputeResultsHash).
+func (state State) WithResultsHash(resultsHash []byte) State {
+	newState := state.Copy()
+	newState.LastResultsHash = resultsHash
+	return newState
+}
+
+// WithValidators returns a copy of the State with Validators set to a copy of
+// the given validator set.
+func (state State) WithValidators(vals *types.ValidatorSet) State {
+	newState := state.Copy()
+	newState.Validators = vals.Copy()
+	return newState
+}
+
+// WithNextValidators returns a copy of the State with NextValidators set to a
+// copy of the given validator set.
+func (state State) WithNextValidators(vals *types.ValidatorSet) State {
+	newState := state.Copy()
+	newState.NextValidators = vals.Copy()
+	return newState
+}
+
+// WithLastValidators returns a copy of the State with LastValidators set to a
+// copy of the given validator set.
+func (state State) WithLastValidators(vals *types.ValidatorSet) State {
+	newState := state.Copy()
+	newState.LastValidators = vals.Copy()
+	return newState
+}
+
+// StateView is a read-only view of the scalar fields of a State and the hashes
+// of its validator sets. It doesn't alias any data of the State, so it can be
+// shared across goroutines, e.g. by RPC handlers, without copying the
+// validator sets.
+type StateView struct {
+	Version         Version
+	ChainID         string
+	InitialHeight   int64
+	LastBlockHeight int64
+	LastBlockID     types.BlockID
+	LastBlockTime   time.Time
+
+	ValidatorsHash     []byte
+	NextValidatorsHash []byte
+	LastValidatorsHash []byte
+
+	LastResultsHash []byte
+	AppHash         []byte
+}
+
+// ImmutableView returns a StateView of the State.
+func (state State) ImmutableView() StateView {
+	return StateView{
+		Version:         state.Version,
+		ChainID:         state.ChainID,
+		InitialHeight:   state.InitialHeight,
+		LastBlockHeight: state.LastBlockHeight,
+		LastBlockID: types.BlockID{
+			Hash: copyBytes(state.LastBlockID.Hash),
+			PartsHeader: types.PartSetHeader{
+				Total: state.LastBlockID.PartsHeader.Total,
+				Hash:  copyBytes(state.LastBlockID.PartsHeader.Hash),
+			},
+		},
+		LastBlockTime: state.LastBlockTime,
+
+		ValidatorsHash:     valSetHash(state.Validators),
+		NextValidatorsHash: valSetHash(state.NextValidators),
+		LastValidatorsHash: valSetHash(state.LastValidators),
+
+		LastResultsHash: copyBytes(state.LastResultsHash),
+		AppHash:         copyBytes(state.AppHash),
+	}
+}
+
+func valSetHash(vals *types.ValidatorSet) []byte {
+	if vals == nil {
+		return nil
+	}
+	return vals.Hash()
+}
+
+func copyBytes(bz []byte) []byte {
+	if bz == nil {
+		return nil
+	}
+	return append([]byte{}, bz...)
+}
+
+// WithConsensusParams returns a copy of the State with ConsensusParams set to a
+// copy of the given params, changed at changedHeight. It returns an error if
+// the params are invalid or changedHeight is outside [InitialHeight,
+// LastBlockHeight+1].
+func (state State) WithConsensusParams(params types.ConsensusParams, changedHeight int64) (State, error) {
+	if err := params.Validate(); err != nil {
+		return state, fmt.Errorf("invalid consensus params: %w", err)
+	}
+	if changedHeight < state.InitialHeight || changedHeight > state.LastBlockHeight+1 {
+		return state, fmt.Errorf("consensus params change height %d must be in [%d, %d]",
+			changedHeight,
+			state.InitialHeight,
+			state.LastBlockHeight+1,
+		)
+	}
+
+	newState := state.Copy()
+	newState.ConsensusParams = copyConsensusParams(params)
+	newState.LastHeightConsensusParamsChanged = changedHeight
+	return newState, nil
 }
 
 // Equals returns true if the States are identical.
+// NOTE: the comparison includes the ProposerPriority of every validator in
+// the validator sets. Priorities determine the proposer of upcoming rounds and
+// are persisted with the validator sets, so two states that only differ in
+// priorities are not considered equal.
 func (state State) Equals(state2 State) bool {
 	sbz, s2bz := state.Bytes(), state2.Bytes()
 	return bytes.Equal(sbz, s2bz)
@@ -117,11 +309,302 @@ func (state State) Bytes() []byte {
 	return cdc.MustMarshalBinaryBare(state)
 }
 
+// stateEncodingVersion is the version of the encoding produced by
+// MarshalVersioned, which state bundles (see ExportBundle) are built on. It
+// must be bumped whenever the serialization of the State changes in a way
+// older binaries can't read.
+const stateEncodingVersion byte = 1
+
+// MarshalVersioned serializes the State like Bytes, prefixed with a version
+// byte, so that a loader can detect an encoding it doesn't know instead of
+// misparsing it.
+func (state State) MarshalVersioned() []byte {
+	return append([]byte{stateEncodingVersion}, state.Bytes()...)
+}
+
+// UnmarshalVersioned deserializes a State produced by MarshalVersioned. It
+// returns an error if bz is empty or was encoded with an unknown version.
+func UnmarshalVersioned(bz []byte) (State, error) {
+	var state State
+	if len(bz) == 0 {
+		return state, errors.New("empty state bytes")
+	}
+	if v := bz[0]; v != stateEncodingVersion {
+		return state, fmt.Errorf("unknown state encoding version %d, expected %d", v, stateEncodingVersion)
+	}
+	if err := cdc.UnmarshalBinaryBare(bz[1:], &state); err != nil {
+		return state, fmt.Errorf("can't decode state: %w", err)
+	}
+	return state, nil
+}
+
+// ChainIDBytes returns the UTF-8 bytes of the ChainID, for use in hashing
+// contexts.
+func (state State) ChainIDBytes() []byte {
+	return []byte(state.ChainID)
+}
+
+// Summary returns a concise, one-line description of the State for logging. It
+// is safe to call on an empty or partially populated State.
+func (state State) Summary() string {
+	return fmt.Sprintf("State{%s #%d vals:%d nextVals:%d appHash:%X v%d/%d/%s}",
+		state.ChainID,
+		state.LastBlockHeight,
+		valSetSize(state.Validators),
+		valSetSize(state.NextValidators),
+		tmbytes.Fingerprint(state.AppHash),
+		state.Version.Consensus.Block,
+		state.Version.Consensus.App,
+		state.Version.Software,
+	)
+}
+
+func valSetSize(vals *types.ValidatorSet) int {
+	if vals == nil {
+		return 0
+	}
+	return vals.Size()
+}
+
 // IsEmpty returns true if the State is equal to the empty State.
 func (state State) IsEmpty() bool {
 	return state.Validators == nil // XXX can't compare to Empty
 }
 
+// EnsureValidatorSets sets any nil Validators, NextValidators or
+// LastValidators to an empty validator set, so the State can be used without
+// nil checks. Sets which are already present are left untouched.
+func (state *State) EnsureValidatorSets() {
+	if state.Validators == nil {
+		state.Validators = types.NewValidatorSet(nil)
+	}
+	if state.NextValidators == nil {
+		state.NextValidators = types.NewValidatorSet(nil)
+	}
+	if state.LastValidators == nil {
+		state.LastValidators = types.NewValidatorSet(nil)
+	}
+}
+
+// IsGenesis returns true if the State is the genesis state, i.e. no block has
+// been committed yet.
+func (state State) IsGenesis() bool {
+	return state.LastBlockHeight == 0
+}
+
+// GenesisValidators returns the state's current validator set as genesis
+// validators, ordered as in the validator set. For a genesis state (see
+// IsGenesis) these are the validators of the originating GenesisDoc. Validator
+// names aren't part of the State and are left empty.
+func (state State) GenesisValidators() []types.GenesisValidator {
+	if state.Validators == nil {
+		return nil
+	}
+	vals := make([]types.GenesisValidator, len(state.Validators.Validators))
+	for i, val := range state.Validators.Validators {
+		vals[i] = types.GenesisValidator{
+			Address: val.Address,
+			PubKey:  val.PubKey,
+			Power:   val.VotingPower,
+		}
+	}
+	return vals
+}
+
+// ValidateBasic performs basic validation of the State which doesn't require
+// access to the database. It is used to catch a corrupted State loaded from
+// disk before it's used to build or validate blocks.
+func (state State) ValidateBasic() error {
+	if err := state.Version.ValidateBasic(); err != nil {
+		return err
+	}
+
+	if state.InitialHeight < 1 {
+		return fmt.Errorf("InitialHeight must be positive, got %d", state.InitialHeight)
+	}
+
+	if len(state.ChainID) == 0 {
+		return errors.New("empty ChainID")
+	}
+	if len(state.ChainID) > types.MaxChainIDLen {
+		return fmt.Errorf("ChainID is too long. Max is %d, got %d", types.MaxChainIDLen, len(state.ChainID))
+	}
+
+	// LastBlockID must be zero at genesis, and set afterwards.
+	switch {
+	case state.LastBlockHeight < 0:
+		return fmt.Errorf("negative LastBlockHeight %d", state.LastBlockHeight)
+	case state.LastBlockHeight == 0 && !state.LastBlockID.IsZero():
+		return fmt.Errorf("expected zero LastBlockID at genesis, got %v", state.LastBlockID)
+	case state.LastBlockHeight > 0 && state.LastBlockID.IsZero():
+		return fmt.Errorf("missing LastBlockID for LastBlockHeight %d", state.LastBlockHeight)
+	case state.LastBlockHeight > 0:
+		if err := state.LastBlockID.ValidateBasic(); err != nil {
+			return fmt.Errorf("invalid LastBlockID: %w", err)
+		}
+	}
+
+	// Pending consensus params must be in the future and ordered.
+	lastHeight := state.LastBlockHeight + 1
+	for _, pending := range state.PendingConsensusParams {
+		if pending.Update == nil {
+			return fmt.Errorf("empty pending consensus params update at height %d", pending.Height)
+		}
+		if pending.Height <= lastHeight {
+			return fmt.Errorf("pending consensus params at height %d must be after %d", pending.Height, lastHeight)
+		}
+		lastHeight = pending.Height
+	}
+
+	// NOTE: AppHash is arbitrary length
+	if err := types.ValidateHash(state.LastResultsHash); err != nil {
+		return fmt.Errorf("invalid LastResultsHash: %w", err)
+	}
+
+	// Empty sets are fine: there are no LastValidators at genesis, and the
+	// genesis validators may be set by InitChain.
+	for _, vals := range []struct {
+		name string
+		set  *types.ValidatorSet
+	}{
+		{"NextValidators", state.NextValidators},
+		{"Validators", state.Validators},
+		{"LastValidators", state.LastValidators},
+	} {
+		if vals.set.IsNilOrEmpty() {
+			continue
+		}
+		if err := checkValidatorSet(vals.set); err != nil {
+			return fmt.Errorf("invalid %s: %w", vals.name, err)
+		}
+	}
+
+	return nil
+}
+
+// ValidateBasic checks the consensus block protocol is set and is one this
+// software can produce, and that the software version is a semantic version.
+// The app version may be zero until the Handshake.
+func (v Version) ValidateBasic() error {
+	if v.Consensus.Block == 0 {
+		return ErrInvalidVersion{Version: v, Reason: "block protocol version must be non-zero"}
+	}
+	if v.Consensus.Block > version.BlockProtocol {
+		return ErrInvalidVersion{
+			Version: v,
+			Reason:  fmt.Sprintf("block protocol version is higher than supported (%d)", version.BlockProtocol),
+		}
+	}
+	if v.Software == "" {
+		return ErrInvalidVersion{Version: v, Reason: "empty software version"}
+	}
+	if !softwareVersionPattern.MatchString(v.Software) {
+		return ErrInvalidVersion{Version: v, Reason: "software version is not a semantic version"}
+	}
+	return nil
+}
+
+// CanValidateHeight returns whether the state's in-memory validator sets
+// include the validator set of the given height and, if not, why. The state at
+// LastBlockHeight H holds the sets of heights H (LastValidators), H+1
+// (Validators) and H+2 (NextValidators); earlier heights are covered only if the
+// validator set hasn't changed since. Otherwise the validator set must be loaded
+// from the store (see LoadValidators).
+func (state State) CanValidateHeight(height int64) (bool, string) {
+	switch {
+	case height < state.InitialHeight:
+		return false, fmt.Sprintf("height %d is before the initial height %d", height, state.InitialHeight)
+	case height > state.LastBlockHeight+2:
+		return false, fmt.Sprintf("validators for height %d aren't known yet (last block height %d)",
+			height, state.LastBlockHeight)
+	case height >= state.LastBlockHeight:
+		return true, ""
+	case height >= state.LastHeightValidatorsChanged:
+		// unchanged since height, so the current sets apply
+		return true, ""
+	default:
+		return false, fmt.Sprintf("need historical validators from store: validators changed at height %d",
+			state.LastHeightValidatorsChanged)
+	}
+}
+
+// ScheduleConsensusParams returns a copy of the State with the given consensus
+// param update scheduled to take effect at the given height, i.e. to be merged
+// into the ConsensusParams of the state used to validate the block at that
+// height, after any update returned by EndBlock. The height must be beyond the
+// next block, whose params are already fixed, and after any already scheduled
+// change.
+// NOTE: scheduled params change the ConsensusHash of the block at that height,
+// so every node must schedule the same changes: this must only be driven by
+// deterministic, replicated input, never by node-local configuration.
+func (state State) ScheduleConsensusParams(height int64, update *abci.ConsensusParams) (State, error) {
+	if height <= state.LastBlockHeight+1 {
+		return state, fmt.Errorf("can't schedule consensus params at height %d, must be after %d",
+			height,
+			state.LastBlockHeight+1,
+		)
+	}
+	if n := len(state.PendingConsensusParams); n > 0 && height <= state.PendingConsensusParams[n-1].Height {
+		return state, fmt.Errorf("can't schedule consensus params at height %d, must be after last scheduled height %d",
+			height,
+			state.PendingConsensusParams[n-1].Height,
+		)
+	}
+	if update == nil {
+		return state, errors.New("can't schedule an empty consensus params update")
+	}
+	// The update is validated again against the params in effect at height.
+	params := state.ConsensusParams.Update(update)
+	if err := params.Validate(); err != nil {
+		return state, fmt.Errorf("invalid consensus params: %w", err)
+	}
+
+	newState := state.Copy()
+	newState.PendingConsensusParams = append(newState.PendingConsensusParams,
+		ScheduledConsensusParams{Height: height, Update: copyConsensusParamsUpdate(update)})
+	return newState, nil
+}
+
+func copyConsensusParamsUpdate(update *abci.ConsensusParams) *abci.ConsensusParams {
+	updateCopy := &abci.ConsensusParams{}
+	if update.Block != nil {
+		block := *update.Block
+		updateCopy.Block = &block
+	}
+	if update.Evidence != nil {
+		evidence := *update.Evidence
+		updateCopy.Evidence = &evidence
+	}
+	if update.Validator != nil {
+		validator := *update.Validator
+		validator.PubKeyTypes = append([]string{}, update.Validator.PubKeyTypes...)
+		updateCopy.Validator = &validator
+	}
+	return updateCopy
+}
+
+// ApplyConsensusParamUpdate merges the consensus param update returned by
+// EndBlock for the block at atHeight onto the state's params. Only the set
+// fields of update are applied. It returns the merged params and the new value
+// for LastHeightConsensusParamsChanged; a nil update leaves both unchanged.
+func (state State) ApplyConsensusParamUpdate(
+	update *abci.ConsensusParams,
+	atHeight int64,
+) (types.ConsensusParams, int64, error) {
+	if update == nil {
+		return state.ConsensusParams, state.LastHeightConsensusParamsChanged, nil
+	}
+
+	// NOTE: must not mutate state.ConsensusParams
+	nextParams := state.ConsensusParams.Update(update)
+	if err := nextParams.Validate(); err != nil {
+		return state.ConsensusParams, state.LastHeightConsensusParamsChanged,
+			fmt.Errorf("error updating consensus params: %v", err)
+	}
+	// Change results from this height but only applies to the next height.
+	return nextParams, atHeight + 1, nil
+}
+
 //------------------------------------------------------------------------
 // Create a block from the latest state
 
@@ -136,17 +619,114 @@ func (state State) MakeBlock(
 	proposerAddress []byte,
 ) (*types.Block, *types.PartSet) {
 
-	// Build base block with block data.
-	block := types.MakeBlock(height, txs, commit, evidence)
-
 	// Set time.
 	var timestamp time.Time
-	if height == 1 {
+	if height == state.InitialHeight {
 		timestamp = state.LastBlockTime // genesis time
 	} else {
 		timestamp = MedianTime(commit, state.LastValidators)
 	}
 
+	return state.makeBlock(height, txs, commit, evidence, proposerAddress, timestamp)
+}
+
+// MakeBlockAt is like MakeBlock, but uses the given timestamp instead of
+// deriving it from the genesis time or the commit. It is useful for testing and
+// for tools reproducing a specific block. It returns an error if the timestamp
+// is before the state's LastBlockTime.
+func (state State) MakeBlockAt(
+	height int64,
+	txs []types.Tx,
+	commit *types.Commit,
+	evidence []types.Evidence,
+	proposerAddress []byte,
+	timestamp time.Time,
+) (*types.Block, *types.PartSet, error) {
+
+	if timestamp.Before(state.LastBlockTime) {
+		return nil, nil, fmt.Errorf("block time %v is before last block time %v",
+			timestamp,
+			state.LastBlockTime,
+		)
+	}
+
+	block, partSet := state.makeBlock(height, txs, commit, evidence, proposerAddress, timestamp)
+	return block, partSet, nil
+}
+
+// MakeBlockChecked is like MakeBlock, but first verifies that the state's
+// current and next validator sets are internally consistent, since their hashes
+// end up in the block header, and that the commit is for the previous height
+// (or empty for the block at the initial height). It is a debugging aid for
+// catching callers that mutate validator sets in violation of the State
+// contract or pass the wrong commit; such a block would only fail validation
+// much later.
+func (state State) MakeBlockChecked(
+	height int64,
+	txs []types.Tx,
+	commit *types.Commit,
+	evidence []types.Evidence,
+	proposerAddress []byte,
+) (*types.Block, *types.PartSet, error) {
+
+	if err := checkValidatorSet(state.Validators); err != nil {
+		return nil, nil, fmt.Errorf("invalid Validators: %w", err)
+	}
+	if err := checkValidatorSet(state.NextValidators); err != nil {
+		return nil, nil, fmt.Errorf("invalid NextValidators: %w", err)
+	}
+
+	switch {
+	case height == state.InitialHeight:
+		if commit != nil && len(commit.Signatures) != 0 {
+			return nil, nil, fmt.Errorf("block at initial height %d can't have LastCommit signatures", height)
+		}
+	case commit == nil:
+		return nil, nil, fmt.Errorf("missing LastCommit for block at height %d", height)
+	case commit.Height != height-1:
+		return nil, nil, fmt.Errorf("LastCommit is for height %d, expected %d", commit.Height, height-1)
+	}
+
+	block, partSet := state.MakeBlock(height, txs, commit, evidence, proposerAddress)
+	return block, partSet, nil
+}
+
+// checkValidatorSet returns an error if the validator set is empty, isn't
+// sorted by address, has duplicates or contains a validator with non-positive
+// voting power or an address not matching its public key.
+func checkValidatorSet(vals *types.ValidatorSet) error {
+	if vals.IsNilOrEmpty() {
+		return errors.New("validator set is empty")
+	}
+	for i, val := range vals.Validators {
+		switch {
+		case val == nil:
+			return fmt.Errorf("validator #%d is nil", i)
+		case val.PubKey == nil:
+			return fmt.Errorf("validator %X has no public key", val.Address)
+		case !bytes.Equal(val.Address, val.PubKey.Address()):
+			return fmt.Errorf("validator %X has an address not matching its public key", val.Address)
+		case val.VotingPower <= 0:
+			return fmt.Errorf("validator %X has non-positive voting power %d", val.Address, val.VotingPower)
+		case i > 0 && bytes.Compare(vals.Validators[i-1].Address, val.Address) >= 0:
+			return fmt.Errorf("validators are not sorted by address or contain duplicates at #%d", i)
+		}
+	}
+	return nil
+}
+
+func (state State) makeBlock(
+	height int64,
+	txs []types.Tx,
+	commit *types.Commit,
+	evidence []types.Evidence,
+	proposerAddress []byte,
+	timestamp time.Time,
+) (*types.Block, *types.PartSet) {
+
+	// Build base block with block data.
+	block := types.MakeBlock(height, txs, commit, evidence)
+
 	// Fill rest of header with state data.
 	block.Header.Populate(
 		state.Version.Consensus, state.ChainID,
@@ -163,23 +743,97 @@ func (state State) MakeBlock(
 // corresponding validator set. The computed time is always between timestamps of
 // the votes sent by honest processes, i.e., a faulty processes can not arbitrarily increase or decrease the
 // computed value.
+// Signatures of validators not in the set are ignored; see MedianTimeChecked.
 func MedianTime(commit *types.Commit, validators *types.ValidatorSet) time.Time {
-	weightedTimes := make([]*tmtime.WeightedTime, len(commit.Signatures))
+	median, _ := medianTime(commit, validators, false)
+	return median
+}
+
+// MedianTimeChecked is like MedianTime, but returns an error if a signature of
+// the commit references a validator address absent from the validator set,
+// instead of silently computing the time from the remaining votes.
+func MedianTimeChecked(commit *types.Commit, validators *types.ValidatorSet) (time.Time, error) {
+	return medianTime(commit, validators, true)
+}
+
+func medianTime(commit *types.Commit, validators *types.ValidatorSet, strict bool) (time.Time, error) {
+	// Only present signatures are collected, into a pooled buffer, since this
+	// is called for every block and commits can be large.
+	bufp := weightedTimesPool.Get().(*[]tmtime.WeightedTime)
+	weightedTimes := (*bufp)[:0]
 	totalVotingPower := int64(0)
 
 	for i, commitSig := range commit.Signatures {
 		if commitSig.Absent() {
 			continue
 		}
-		_, validator := validators.GetByAddress(commitSig.ValidatorAddress)
+		votingPower, ok := commitSigVotingPower(validators, i, commitSig.ValidatorAddress)
 		// If there's no condition, TestValidateBlockCommit panics; not needed normally.
-		if validator != nil {
-			totalVotingPower += validator.VotingPower
-			weightedTimes[i] = tmtime.NewWeightedTime(commitSig.Timestamp, validator.VotingPower)
+		if !ok {
+			if strict {
+				*bufp = weightedTimes[:0]
+				weightedTimesPool.Put(bufp)
+				return time.Time{}, fmt.Errorf("commit signature #%d references unknown validator %X",
+					i,
+					commitSig.ValidatorAddress,
+				)
+			}
+			continue
 		}
+		totalVotingPower += votingPower
+		weightedTimes = append(weightedTimes, tmtime.WeightedTime{
+			Time:   commitSig.Timestamp,
+			Weight: votingPower,
+		})
+	}
+
+	median := weightedMedian(weightedTimes, totalVotingPower)
+
+	*bufp = weightedTimes[:0]
+	weightedTimesPool.Put(bufp)
+
+	return median, nil
+}
+
+var weightedTimesPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]tmtime.WeightedTime, 0, 128)
+		return &buf
+	},
+}
+
+// commitSigVotingPower returns the voting power of the validator with the given
+// address, which signed the commit at the given index. Signatures are ordered
+// like the validator set, so the validator at the same index is tried before
+// looking it up by address.
+func commitSigVotingPower(validators *types.ValidatorSet, idx int, address []byte) (int64, bool) {
+	if idx < len(validators.Validators) && bytes.Equal(validators.Validators[idx].Address, address) {
+		return validators.Validators[idx].VotingPower, true
+	}
+	_, validator := validators.GetByAddress(address)
+	if validator == nil {
+		return 0, false
 	}
+	return validator.VotingPower, true
+}
 
-	return tmtime.WeightedMedian(weightedTimes, totalVotingPower)
+// weightedMedian is the same as tmtime.WeightedMedian, but works on a slice of
+// values without nil entries.
+func weightedMedian(weightedTimes []tmtime.WeightedTime, totalVotingPower int64) (res time.Time) {
+	median := totalVotingPower / 2
+
+	sort.Slice(weightedTimes, func(i, j int) bool {
+		return weightedTimes[i].Time.UnixNano() < weightedTimes[j].Time.UnixNano()
+	})
+
+	for _, weightedTime := range weightedTimes {
+		if median <= weightedTime.Weight {
+			res = weightedTime.Time
+			break
+		}
+		median -= weightedTime.Weight
+	}
+	return
 }
 
 //------------------------------------------------------------------------
@@ -210,7 +864,39 @@ func MakeGenesisDocFromFile(genDocFile string) (*types.GenesisDoc, error) {
 	return genDoc, nil
 }
 
+// GenesisDocHash returns the hash of the amino encoding of the given genesis
+// doc, completed with defaults (see GenesisDoc.ValidateAndComplete). The
+// genesis time must be set, like in MakeGenesisState.
+func GenesisDocHash(genDoc *types.GenesisDoc) ([]byte, error) {
+	if err := genDoc.ValidateAndComplete(); err != nil {
+		return nil, fmt.Errorf("error in genesis file: %v", err)
+	}
+	bz, err := cdc.MarshalBinaryBare(genDoc)
+	if err != nil {
+		return nil, fmt.Errorf("can't encode genesis doc: %w", err)
+	}
+	return tmhash.Sum(bz), nil
+}
+
+// MakeGenesisStateWithHash is like MakeGenesisState, but first checks that the
+// genesis doc hashes to expectedHash (see GenesisDocHash). It lets operators
+// pin the exact genesis they intend to join.
+func MakeGenesisStateWithHash(genDoc *types.GenesisDoc, expectedHash []byte) (State, error) {
+	hash, err := GenesisDocHash(genDoc)
+	if err != nil {
+		return State{}, err
+	}
+	if !bytes.Equal(hash, expectedHash) {
+		return State{}, fmt.Errorf("genesis doc hash mismatch: expected %X, got %X", expectedHash, hash)
+	}
+	return MakeGenesisState(genDoc)
+}
+
 // MakeGenesisState creates state from types.GenesisDoc.
+// The genesis time must be set (see GenesisDoc.ValidateAndComplete); it's
+// normalized to UTC. The order of the
+// genesis validators is normalized too: NewValidatorSet sorts them by address,
+// so it doesn't matter in which order they're listed in the GenesisDoc.
 func MakeGenesisState(genDoc *types.GenesisDoc) (State, error) {
 	err := genDoc.ValidateAndComplete()
 	if err != nil {
@@ -223,11 +909,21 @@ func MakeGenesisState(genDoc *types.GenesisDoc) (State, error) {
 		nextValidatorSet = types.NewValidatorSet(nil)
 	} else {
 		validators := make([]*types.Validator, len(genDoc.Validators))
+		seen := make(map[string]struct{}, len(genDoc.Validators))
 		for i, val := range genDoc.Validators {
+			// Duplicates would otherwise make NewValidatorSet panic.
+			address := val.PubKey.Address()
+			if _, ok := seen[string(address)]; ok {
+				return State{}, fmt.Errorf("error in genesis file: duplicate validator %v", address)
+			}
+			seen[string(address)] = struct{}{}
 			validators[i] = types.NewValidator(val.PubKey, val.Power)
 		}
 		validatorSet = types.NewValidatorSet(validators)
-		nextValidatorSet = types.NewValidatorSet(validators).CopyIncrementProposerPriority(1)
+		nextValidatorSet = validatorSet.CopyIncrementProposerPriority(1)
+	}
+	if !bytes.Equal(validatorSet.Hash(), nextValidatorSet.Hash()) {
+		return State{}, errors.New("genesis validators and next validators differ")
 	}
 
 	return State{
@@ -236,7 +932,7 @@ func MakeGenesisState(genDoc *types.GenesisDoc) (State, error) {
 
 		LastBlockHeight: 0,
 		LastBlockID:     types.BlockID{},
-		LastBlockTime:   genDoc.GenesisTime,
+		LastBlockTime:   tmtime.Canonical(genDoc.GenesisTime),
 
 		NextValidators:              nextValidatorSet,
 		Validators:                  validatorSet,
@@ -247,5 +943,7 @@ func MakeGenesisState(genDoc *types.GenesisDoc) (State, error) {
 		LastHeightConsensusParamsChanged: 1,
 
 		AppHash: genDoc.AppHash,
+
+		InitialHeight: 1,
 	}, nil
 }
@@ -3,9 +3,11 @@ package state_test
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"math"
 	"math/big"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -17,11 +19,14 @@ import (
 	abci "github.com/tendermint/tendermint/abci/types"
 	cfg "github.com/tendermint/tendermint/config"
 	"github.com/tendermint/tendermint/crypto/ed25519"
+	"github.com/tendermint/tendermint/crypto/tmhash"
 	"github.com/tendermint/tendermint/libs/kv"
 	"github.com/tendermint/tendermint/libs/rand"
 	tmrand "github.com/tendermint/tendermint/libs/rand"
 	sm "github.com/tendermint/tendermint/state"
 	"github.com/tendermint/tendermint/types"
+	tmtime "github.com/tendermint/tendermint/types/time"
+	"github.com/tendermint/tendermint/version"
 )
 
 // setupTestCase does setup common to all test cases.
@@ -54,11 +59,134 @@ func TestStateCopy(t *testing.T) {
         %v`, state))
 }
 
-//TestMakeGenesisStateNilValidators tests state's consistency when genesis file's validators field is nil.
+// TestStateCopyPtr tests that CopyPtr returns a deep copy of the State.
+func TestStateCopyPtr(t *testing.T) {
+	tearDown, _, state := setupTestCase(t)
+	defer tearDown(t)
+
+	stateCopy := state.CopyPtr()
+	require.NotNil(t, stateCopy)
+	assert.True(t, state.Equals(*stateCopy))
+	assert.Equal(t, state.Copy(), *stateCopy)
+
+	stateCopy.LastBlockHeight++
+	stateCopy.Validators.Validators[0].VotingPower++
+	assert.False(t, state.Equals(*stateCopy))
+	assert.NotEqual(t, state.Validators.Validators[0].VotingPower, stateCopy.Validators.Validators[0].VotingPower)
+
+	var nilState *sm.State
+	assert.Nil(t, nilState.CopyPtr())
+}
+
+// TestStateMarshalVersioned tests that a versioned State round-trips and that
+// unknown encoding versions are rejected.
+func TestStateMarshalVersioned(t *testing.T) {
+	tearDown, _, state := setupTestCase(t)
+	defer tearDown(t)
+
+	bz := state.MarshalVersioned()
+	loaded, err := sm.UnmarshalVersioned(bz)
+	require.NoError(t, err)
+	assert.True(t, state.Equals(loaded))
+	assert.Equal(t, state.Bytes(), bz[1:])
+
+	future := append([]byte{bz[0] + 1}, bz[1:]...)
+	_, err = sm.UnmarshalVersioned(future)
+	assert.Error(t, err)
+
+	_, err = sm.UnmarshalVersioned(nil)
+	assert.Error(t, err)
+
+	_, err = sm.UnmarshalVersioned(bz[:len(bz)/2])
+	assert.Error(t, err)
+}
+
+// TestStateImmutableView tests that the view reflects the State and doesn't
+// alias its data.
+func TestStateImmutableView(t *testing.T) {
+	state, _, _ := makeState(3, 5)
+	state.LastBlockID = types.BlockID{
+		Hash:        tmrand.Bytes(tmhash.Size),
+		PartsHeader: types.PartSetHeader{Total: 1, Hash: tmrand.Bytes(tmhash.Size)},
+	}
+	state.AppHash = tmrand.Bytes(tmhash.Size)
+	state.LastResultsHash = tmrand.Bytes(tmhash.Size)
+
+	view := state.ImmutableView()
+	assert.Equal(t, state.Version, view.Version)
+	assert.Equal(t, state.ChainID, view.ChainID)
+	assert.Equal(t, state.InitialHeight, view.InitialHeight)
+	assert.Equal(t, state.LastBlockHeight, view.LastBlockHeight)
+	assert.Equal(t, state.LastBlockID, view.LastBlockID)
+	assert.Equal(t, state.LastBlockTime, view.LastBlockTime)
+	assert.EqualValues(t, state.Validators.Hash(), view.ValidatorsHash)
+	assert.EqualValues(t, state.NextValidators.Hash(), view.NextValidatorsHash)
+	assert.EqualValues(t, state.LastValidators.Hash(), view.LastValidatorsHash)
+	assert.Equal(t, state.AppHash, view.AppHash)
+	assert.Equal(t, state.LastResultsHash, view.LastResultsHash)
+
+	// mutating the state doesn't affect the view
+	appHash := append([]byte{}, state.AppHash...)
+	blockHash := append([]byte{}, state.LastBlockID.Hash...)
+	state.AppHash[0]++
+	state.LastBlockID.Hash[0]++
+	state.LastBlockID.PartsHeader.Hash[0]++
+	state.LastResultsHash[0]++
+	assert.Equal(t, appHash, view.AppHash)
+	assert.EqualValues(t, blockHash, view.LastBlockID.Hash)
+	assert.NotEqual(t, state.LastBlockID.PartsHeader.Hash, view.LastBlockID.PartsHeader.Hash)
+	assert.NotEqual(t, state.LastResultsHash, view.LastResultsHash)
+
+	assert.Nil(t, sm.State{}.ImmutableView().ValidatorsHash)
+}
+
+func BenchmarkStateCopy(b *testing.B) {
+	state, _, _ := makeState(100, 1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = state.Copy()
+	}
+}
+
+func BenchmarkStateCopyPtr(b *testing.B) {
+	state, _, _ := makeState(100, 1)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = state.CopyPtr()
+	}
+}
+
+// TestStateEqualsProposerPriority tests that proposer priorities are part of
+// the State identity, i.e. changing any priority makes the states unequal.
+func TestStateEqualsProposerPriority(t *testing.T) {
+	state, _, _ := makeState(4, 1)
+
+	for i := 0; i < 100; i++ {
+		stateCopy := state.Copy()
+		require.True(t, state.Equals(stateCopy))
+
+		var valSet *types.ValidatorSet
+		switch tmrand.Intn(2) {
+		case 0:
+			valSet = stateCopy.Validators
+		case 1:
+			valSet = stateCopy.NextValidators
+		}
+		valSet.Validators[tmrand.Intn(valSet.Size())].ProposerPriority += tmrand.Int63n(1000) + 1
+
+		assert.False(t, state.Equals(stateCopy),
+			"expected states with different proposer priorities to be unequal (iteration %d)", i)
+	}
+}
+
+// TestMakeGenesisStateNilValidators tests state's consistency when genesis file's validators field is nil.
 func TestMakeGenesisStateNilValidators(t *testing.T) {
 	doc := types.GenesisDoc{
-		ChainID:    "dummy",
-		Validators: nil,
+		GenesisTime: tmtime.Now(),
+		ChainID:     "dummy",
+		Validators:  nil,
 	}
 	require.Nil(t, doc.ValidateAndComplete())
 	state, err := sm.MakeGenesisState(&doc)
@@ -67,6 +195,211 @@ func TestMakeGenesisStateNilValidators(t *testing.T) {
 	require.Equal(t, 0, len(state.NextValidators.Validators))
 }
 
+// TestMakeGenesisStateNextValidators tests that the genesis next validators
+// are the genesis validators, one proposer priority increment ahead.
+func TestMakeGenesisStateNextValidators(t *testing.T) {
+	genDoc := randomGenesisDoc()
+	for i := 0; i < 3; i++ {
+		pubKey := ed25519.GenPrivKey().PubKey()
+		genDoc.Validators = append(genDoc.Validators, types.GenesisValidator{
+			Address: pubKey.Address(),
+			PubKey:  pubKey,
+			Power:   int64(i + 1),
+		})
+	}
+
+	state, err := sm.MakeGenesisState(genDoc)
+	require.NoError(t, err)
+	assert.Equal(t, state.Validators.Hash(), state.NextValidators.Hash())
+	assert.Equal(t, state.Validators.CopyIncrementProposerPriority(1), state.NextValidators)
+
+	// the sets don't share validators
+	state.NextValidators.Validators[0].VotingPower++
+	assert.NotEqual(t, state.Validators.Hash(), state.NextValidators.Hash())
+}
+
+// TestMakeGenesisStateGenesisTime tests that the genesis time must be set and
+// is normalized to UTC.
+func TestMakeGenesisStateGenesisTime(t *testing.T) {
+	genDoc := randomGenesisDoc()
+	genDoc.GenesisTime = time.Time{}
+	_, err := sm.MakeGenesisState(genDoc)
+	assert.Error(t, err)
+
+	utcTime := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	genDoc.GenesisTime = utcTime
+	state, err := sm.MakeGenesisState(genDoc)
+	require.NoError(t, err)
+	assert.Equal(t, utcTime, state.LastBlockTime)
+
+	genDoc.GenesisTime = utcTime.In(time.FixedZone("UTC+2", 2*60*60))
+	state, err = sm.MakeGenesisState(genDoc)
+	require.NoError(t, err)
+	assert.Equal(t, utcTime, state.LastBlockTime)
+	assert.Equal(t, time.UTC, state.LastBlockTime.Location())
+}
+
+// TestMakeGenesisStateValidatorOrder tests that the order of the genesis
+// validators doesn't matter.
+func TestMakeGenesisStateValidatorOrder(t *testing.T) {
+	genDoc := randomGenesisDoc()
+	for i := 0; i < 4; i++ {
+		pubKey := ed25519.GenPrivKey().PubKey()
+		genDoc.Validators = append(genDoc.Validators, types.GenesisValidator{
+			Address: pubKey.Address(),
+			PubKey:  pubKey,
+			Power:   10,
+		})
+	}
+	state, err := sm.MakeGenesisState(genDoc)
+	require.NoError(t, err)
+
+	vals := genDoc.Validators
+	for i, j := 0, len(vals)-1; i < j; i, j = i+1, j-1 {
+		vals[i], vals[j] = vals[j], vals[i]
+	}
+	reversed, err := sm.MakeGenesisState(genDoc)
+	require.NoError(t, err)
+
+	assert.True(t, state.Equals(reversed))
+	assert.Equal(t, state.GenesisValidators(), reversed.GenesisValidators())
+}
+
+// TestStateGenesisValidators tests that the genesis validators can be
+// recovered from a genesis state.
+func TestStateGenesisValidators(t *testing.T) {
+	genDoc := randomGenesisDoc()
+	pubKey := ed25519.GenPrivKey().PubKey()
+	genDoc.Validators = append(genDoc.Validators, types.GenesisValidator{
+		Address: pubKey.Address(),
+		PubKey:  pubKey,
+		Power:   20,
+		Name:    "otherval",
+	})
+	state, err := sm.MakeGenesisState(genDoc)
+	require.NoError(t, err)
+	require.True(t, state.IsGenesis())
+
+	vals := state.GenesisValidators()
+	require.Len(t, vals, len(genDoc.Validators))
+	for _, genVal := range genDoc.Validators {
+		found := false
+		for _, val := range vals {
+			if bytes.Equal(val.Address, genVal.Address) {
+				found = true
+				assert.Equal(t, genVal.PubKey, val.PubKey)
+				assert.Equal(t, genVal.Power, val.Power)
+			}
+		}
+		assert.True(t, found, "genesis validator %X not found", genVal.Address)
+	}
+
+	state.LastBlockHeight++
+	assert.False(t, state.IsGenesis())
+
+	assert.Nil(t, sm.State{}.GenesisValidators())
+}
+
+// TestMakeGenesisStateDuplicateValidators tests that a genesis file with two
+// validators sharing a pubkey is rejected.
+func TestMakeGenesisStateDuplicateValidators(t *testing.T) {
+	genDoc := randomGenesisDoc()
+	dup := genDoc.Validators[0]
+	dup.Name = "dupval"
+	dup.Power = 20
+	genDoc.Validators = append(genDoc.Validators, dup)
+
+	_, err := sm.MakeGenesisState(genDoc)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), dup.PubKey.Address().String())
+}
+
+func TestMakeGenesisStateWithHash(t *testing.T) {
+	genDoc := randomGenesisDoc()
+	hash, err := sm.GenesisDocHash(genDoc)
+	require.NoError(t, err)
+
+	state, err := sm.MakeGenesisStateWithHash(genDoc, hash)
+	require.NoError(t, err)
+	expected, err := sm.MakeGenesisState(genDoc)
+	require.NoError(t, err)
+	assert.True(t, expected.Equals(state))
+
+	// any change to the doc changes its hash
+	genDoc.Validators[0].Power++
+	_, err = sm.MakeGenesisStateWithHash(genDoc, hash)
+	assert.Error(t, err)
+}
+
+// TestMakeGenesisStateWithHashZeroTime tests that a genesis doc without a
+// genesis time can't be hashed, so MakeGenesisStateWithHash can't be used to
+// get around the genesis time check of MakeGenesisState.
+func TestMakeGenesisStateWithHashZeroTime(t *testing.T) {
+	genDoc := randomGenesisDoc()
+	genDoc.GenesisTime = time.Time{}
+
+	hash, err := sm.GenesisDocHash(genDoc)
+	require.Error(t, err)
+	assert.Nil(t, hash)
+	assert.True(t, genDoc.GenesisTime.IsZero(), "genesis doc must not be completed")
+
+	_, err = sm.MakeGenesisStateWithHash(genDoc, hash)
+	assert.Error(t, err)
+}
+
+// TestGenesisDocHashFromFile tests that the hash of a genesis file is stable
+// across loads, and that a genesis file without a genesis time is rejected
+// instead of being completed with the current time.
+func TestGenesisDocHashFromFile(t *testing.T) {
+	const genDocJSON = `{%s"chain_id":"test-chain","validators":[` +
+		`{"pub_key":{"type":"tendermint/PubKeyEd25519","value":"AT/+aaL1eB0477Mud9JMm8Sh8BIvOYlPGC9KkIUmFaE="},` +
+		`"power":"10","name":""}]}`
+
+	tmpfile, err := ioutil.TempFile("", "genesis")
+	require.NoError(t, err)
+	defer os.Remove(tmpfile.Name())
+	writeGenDoc := func(genesisTime string) {
+		err := ioutil.WriteFile(tmpfile.Name(), []byte(fmt.Sprintf(genDocJSON, genesisTime)), 0600)
+		require.NoError(t, err)
+	}
+
+	writeGenDoc(`"genesis_time":"2020-05-01T12:00:00Z",`)
+	var hashes [][]byte
+	for i := 0; i < 2; i++ {
+		genDoc, err := sm.MakeGenesisDocFromFile(tmpfile.Name())
+		require.NoError(t, err)
+		hash, err := sm.GenesisDocHash(genDoc)
+		require.NoError(t, err)
+		hashes = append(hashes, hash)
+	}
+	assert.Equal(t, hashes[0], hashes[1])
+
+	writeGenDoc("")
+	_, err = sm.MakeGenesisDocFromFile(tmpfile.Name())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "genesis_time")
+}
+
+func TestStateSummary(t *testing.T) {
+	genesis, err := sm.MakeGenesisState(randomGenesisDoc())
+	require.NoError(t, err)
+	assert.Equal(t,
+		fmt.Sprintf("State{abc #0 vals:1 nextVals:1 appHash:000000000000 v%d/0/%s}",
+			version.BlockProtocol, version.TMCoreSemVer),
+		genesis.Summary())
+
+	state, _, _ := makeState(3, 5)
+	state.LastBlockHeight = 5
+	state.AppHash = []byte{0xAB, 0xCD, 0xEF, 0x01, 0x23, 0x45, 0x67}
+	state.Version.Consensus.App = 2
+	assert.Equal(t,
+		fmt.Sprintf("State{%s #5 vals:3 nextVals:3 appHash:ABCDEF012345 v%d/2/%s}",
+			state.ChainID, version.BlockProtocol, version.TMCoreSemVer),
+		state.Summary())
+
+	assert.Equal(t, "State{ #0 vals:0 nextVals:0 appHash:000000000000 v0/0/}", sm.State{}.Summary())
+}
+
 // TestStateSaveLoad tests saving and loading State from a db.
 func TestStateSaveLoad(t *testing.T) {
 	tearDown, stateDB, state := setupTestCase(t)
@@ -82,6 +415,425 @@ func TestStateSaveLoad(t *testing.T) {
 			loadedState, state))
 }
 
+// TestStateInitialHeight tests that InitialHeight is persisted, defaults to 1
+// and determines which block takes the genesis time.
+func TestStateInitialHeight(t *testing.T) {
+	tearDown, stateDB, state := setupTestCase(t)
+	defer tearDown(t)
+	assert.EqualValues(t, 1, state.InitialHeight)
+	assert.Equal(t, state.InitialHeight, state.Copy().InitialHeight)
+
+	state.InitialHeight = 10
+	sm.SaveState(stateDB, state)
+	loadedState := sm.LoadState(stateDB)
+	assert.True(t, state.Equals(loadedState))
+	assert.EqualValues(t, 10, loadedState.InitialHeight)
+
+	// states stored without an InitialHeight start at 1
+	legacyState := state.Copy()
+	legacyState.InitialHeight = 0
+	sm.SaveState(stateDB, legacyState)
+	assert.EqualValues(t, 1, sm.LoadState(stateDB).InitialHeight)
+	assert.Error(t, legacyState.ValidateBasic())
+
+	// the block at the initial height has the genesis time
+	proposerAddress := state.Validators.GetProposer().Address
+	block, _ := state.MakeBlock(10, makeTxs(10), new(types.Commit), nil, proposerAddress)
+	assert.True(t, state.LastBlockTime.Equal(block.Time))
+}
+
+// TestStateValidateBasicVersion tests that states with an unset or unsupported
+// block protocol version, or a malformed software version, are rejected.
+func TestStateValidateBasicVersion(t *testing.T) {
+	tearDown, _, state := setupTestCase(t)
+	defer tearDown(t)
+
+	require.NoError(t, state.ValidateBasic())
+
+	testCases := []struct {
+		name    string
+		version sm.Version
+		wantErr bool
+	}{
+		{"valid", state.Version, false},
+		{"app version set", sm.Version{
+			Consensus: version.Consensus{Block: version.BlockProtocol, App: 1},
+			Software:  state.Version.Software,
+		}, false},
+		{"empty", sm.Version{}, true},
+		{"zero block version", sm.Version{
+			Consensus: version.Consensus{Block: 0, App: 1},
+			Software:  state.Version.Software,
+		}, true},
+		{"unsupported block version", sm.Version{
+			Consensus: version.Consensus{Block: version.BlockProtocol + 1},
+			Software:  state.Version.Software,
+		}, true},
+		{"pre-release software version", sm.Version{
+			Consensus: state.Version.Consensus,
+			Software:  "0.34.0-rc4",
+		}, false},
+		{"prefixed software version with build metadata", sm.Version{
+			Consensus: state.Version.Consensus,
+			Software:  "v0.33.4+a1b2c3d",
+		}, false},
+		{"empty software version", sm.Version{
+			Consensus: state.Version.Consensus,
+		}, true},
+		{"garbage software version", sm.Version{
+			Consensus: state.Version.Consensus,
+			Software:  "tendermint\x00",
+		}, true},
+		{"incomplete software version", sm.Version{
+			Consensus: state.Version.Consensus,
+			Software:  "0.33",
+		}, true},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			stateCopy := state.Copy()
+			stateCopy.Version = tc.version
+			err := stateCopy.ValidateBasic()
+			if tc.wantErr {
+				require.Error(t, err)
+				assert.IsType(t, sm.ErrInvalidVersion{}, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+// TestStateValidateBasicLastBlockID tests that LastBlockID is zero iff
+// LastBlockHeight is zero.
+func TestStateValidateBasicLastBlockID(t *testing.T) {
+	tearDown, _, state := setupTestCase(t)
+	defer tearDown(t)
+
+	blockID := types.BlockID{
+		Hash:        tmrand.Bytes(tmhash.Size),
+		PartsHeader: types.PartSetHeader{Total: 100, Hash: tmrand.Bytes(tmhash.Size)},
+	}
+
+	testCases := []struct {
+		name    string
+		height  int64
+		blockID types.BlockID
+		wantErr bool
+	}{
+		{"genesis", 0, types.BlockID{}, false},
+		{"committed", 1, blockID, false},
+		{"block ID at genesis", 0, blockID, true},
+		{"no block ID after genesis", 1, types.BlockID{}, true},
+		{"negative height", -1, types.BlockID{}, true},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			stateCopy := state.Copy()
+			stateCopy.LastBlockHeight = tc.height
+			stateCopy.LastBlockID = tc.blockID
+			if tc.wantErr {
+				assert.Error(t, stateCopy.ValidateBasic())
+			} else {
+				assert.NoError(t, stateCopy.ValidateBasic())
+			}
+		})
+	}
+}
+
+// TestStateValidateBasicChainID tests that ValidateBasic enforces
+// types.MaxChainIDLen and rejects an empty ChainID.
+func TestStateValidateBasicChainID(t *testing.T) {
+	tearDown, _, state := setupTestCase(t)
+	defer tearDown(t)
+
+	testCases := []struct {
+		name    string
+		chainID string
+		wantErr bool
+	}{
+		{"empty", "", true},
+		{"max length", strings.Repeat("a", types.MaxChainIDLen), false},
+		{"too long", strings.Repeat("a", types.MaxChainIDLen+1), true},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			stateCopy := state.Copy()
+			stateCopy.ChainID = tc.chainID
+			if tc.wantErr {
+				assert.Error(t, stateCopy.ValidateBasic())
+			} else {
+				assert.NoError(t, stateCopy.ValidateBasic())
+			}
+			assert.Equal(t, []byte(tc.chainID), stateCopy.ChainIDBytes())
+		})
+	}
+}
+
+// TestStateValidateBasicLastResultsHash tests that LastResultsHash is either
+// empty or a tmhash, while AppHash may have any length.
+func TestStateValidateBasicLastResultsHash(t *testing.T) {
+	tearDown, _, state := setupTestCase(t)
+	defer tearDown(t)
+
+	testCases := []struct {
+		name        string
+		resultsHash []byte
+		appHash     []byte
+		wantErr     bool
+	}{
+		{"empty", nil, nil, false},
+		{"correct length", tmrand.Bytes(tmhash.Size), tmrand.Bytes(tmhash.Size), false},
+		{"too short", tmrand.Bytes(tmhash.Size - 1), nil, true},
+		{"too long", tmrand.Bytes(tmhash.Size + 1), nil, true},
+		{"app-defined app hash", nil, tmrand.Bytes(8), false},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			stateCopy := state.Copy()
+			stateCopy.LastResultsHash = tc.resultsHash
+			stateCopy.AppHash = tc.appHash
+			if tc.wantErr {
+				assert.Error(t, stateCopy.ValidateBasic())
+			} else {
+				assert.NoError(t, stateCopy.ValidateBasic())
+			}
+		})
+	}
+}
+
+// TestLoadStateWithEmptyVersion tests that a stored state with an empty
+// version is rejected when loading.
+func TestLoadStateWithEmptyVersion(t *testing.T) {
+	tearDown, stateDB, state := setupTestCase(t)
+	defer tearDown(t)
+
+	state.Version = sm.Version{}
+	sm.SaveState(stateDB, state)
+
+	_, err := sm.LoadStateFromDBOrGenesisDoc(stateDB, randomGenesisDoc())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "block protocol version must be non-zero")
+}
+
+// TestLoadStateWithCorruptedValidators tests that a stored state with an
+// inconsistent validator set is rejected when loading.
+func TestLoadStateWithCorruptedValidators(t *testing.T) {
+	tearDown, stateDB, state := setupTestCase(t)
+	defer tearDown(t)
+
+	state.Validators = genValSet(3)
+	state.NextValidators = state.Validators.CopyIncrementProposerPriority(1)
+	state.LastValidators = state.Validators.Copy()
+	sm.SaveState(stateDB, state)
+	_, err := sm.LoadStateFromDBOrGenesisDoc(stateDB, randomGenesisDoc())
+	require.NoError(t, err)
+
+	state.LastValidators.Validators[1].VotingPower = 0
+	sm.SaveState(stateDB, state)
+	_, err = sm.LoadStateFromDBOrGenesisDoc(stateDB, randomGenesisDoc())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid LastValidators")
+}
+
+// TestStateEnsureValidatorSets tests that nil validator sets are replaced with
+// empty ones, both directly and when loading a stored state.
+func TestStateEnsureValidatorSets(t *testing.T) {
+	tearDown, stateDB, state := setupTestCase(t)
+	defer tearDown(t)
+
+	vals := state.Validators
+	state.NextValidators = nil
+	state.LastValidators = nil
+	stateCopy := state
+	stateCopy.EnsureValidatorSets()
+	assert.True(t, vals == stateCopy.Validators, "existing sets must not be replaced")
+	require.NotNil(t, stateCopy.NextValidators)
+	assert.Zero(t, stateCopy.NextValidators.Size())
+	require.NotNil(t, stateCopy.LastValidators)
+	assert.Zero(t, stateCopy.LastValidators.Size())
+	assert.Nil(t, state.LastValidators)
+
+	sm.SaveState(stateDB, state)
+	loaded := sm.LoadState(stateDB)
+	require.NotNil(t, loaded.NextValidators)
+	require.NotNil(t, loaded.LastValidators)
+	assert.Zero(t, loaded.LastValidators.Size())
+
+	// an empty database still yields an empty state
+	assert.True(t, sm.LoadState(dbm.NewMemDB()).IsEmpty())
+}
+
+// TestStateWithAppVersion tests setting the app version after the handshake.
+func TestStateWithAppVersion(t *testing.T) {
+	tearDown, _, state := setupTestCase(t)
+	defer tearDown(t)
+	require.EqualValues(t, 0, state.Version.Consensus.App)
+
+	// set from zero
+	newState, err := state.WithAppVersion(2)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, newState.Version.Consensus.App)
+	assert.EqualValues(t, 0, state.Version.Consensus.App)
+	assert.Equal(t, state.Version.Consensus.Block, newState.Version.Consensus.Block)
+	assert.Equal(t, state.Version.Software, newState.Version.Software)
+
+	// the same version is fine
+	_, err = newState.WithAppVersion(2)
+	require.NoError(t, err)
+
+	// downgrades are rejected
+	_, err = newState.WithAppVersion(1)
+	assert.Error(t, err)
+}
+
+func TestStateWithValidatorSets(t *testing.T) {
+	state, _, _ := makeState(3, 2)
+	orig := state.Copy()
+	vals := genValSet(2)
+
+	cases := []struct {
+		name   string
+		with   func(sm.State) sm.State
+		field  func(sm.State) *types.ValidatorSet
+		others []func(sm.State) *types.ValidatorSet
+	}{
+		{
+			"Validators",
+			func(s sm.State) sm.State { return s.WithValidators(vals) },
+			func(s sm.State) *types.ValidatorSet { return s.Validators },
+			[]func(sm.State) *types.ValidatorSet{
+				func(s sm.State) *types.ValidatorSet { return s.NextValidators },
+				func(s sm.State) *types.ValidatorSet { return s.LastValidators },
+			},
+		},
+		{
+			"NextValidators",
+			func(s sm.State) sm.State { return s.WithNextValidators(vals) },
+			func(s sm.State) *types.ValidatorSet { return s.NextValidators },
+			[]func(sm.State) *types.ValidatorSet{
+				func(s sm.State) *types.ValidatorSet { return s.Validators },
+				func(s sm.State) *types.ValidatorSet { return s.LastValidators },
+			},
+		},
+		{
+			"LastValidators",
+			func(s sm.State) sm.State { return s.WithLastValidators(vals) },
+			func(s sm.State) *types.ValidatorSet { return s.LastValidators },
+			[]func(sm.State) *types.ValidatorSet{
+				func(s sm.State) *types.ValidatorSet { return s.Validators },
+				func(s sm.State) *types.ValidatorSet { return s.NextValidators },
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			newState := tc.with(state)
+
+			// the field is set to a deep copy of vals
+			assert.Equal(t, vals, tc.field(newState))
+			assert.False(t, vals == tc.field(newState))
+			tc.field(newState).Validators[0].VotingPower++
+			assert.NotEqual(t, vals.Validators[0].VotingPower, tc.field(newState).Validators[0].VotingPower)
+
+			// the other fields are kept
+			for _, other := range tc.others {
+				assert.Equal(t, other(state), other(newState))
+			}
+			assert.Equal(t, state.ChainID, newState.ChainID)
+			assert.Equal(t, state.LastBlockHeight, newState.LastBlockHeight)
+			assert.Equal(t, state.LastHeightValidatorsChanged, newState.LastHeightValidatorsChanged)
+			assert.Equal(t, state.ConsensusParams, newState.ConsensusParams)
+			assert.Equal(t, state.AppHash, newState.AppHash)
+
+			// the original is untouched
+			assert.True(t, orig.Equals(state))
+		})
+	}
+}
+
+func TestStateCanValidateHeight(t *testing.T) {
+	tearDown, _, state := setupTestCase(t)
+	defer tearDown(t)
+
+	state.LastBlockHeight = 10
+	state.LastHeightValidatorsChanged = 7
+
+	testCases := []struct {
+		height int64
+		ok     bool
+	}{
+		{0, false},
+		{1, false},
+		{6, false},
+		{7, true},
+		{9, true},
+		{10, true},
+		{11, true},
+		{12, true},
+		{13, false},
+	}
+	for _, tc := range testCases {
+		ok, reason := state.CanValidateHeight(tc.height)
+		assert.Equal(t, tc.ok, ok, "height %d", tc.height)
+		if tc.ok {
+			assert.Empty(t, reason, "height %d", tc.height)
+		} else {
+			assert.NotEmpty(t, reason, "height %d", tc.height)
+		}
+	}
+
+	// a validator set change pending for the next next height
+	state.LastHeightValidatorsChanged = 12
+	ok, reason := state.CanValidateHeight(9)
+	assert.False(t, ok)
+	assert.Contains(t, reason, "need historical validators from store")
+	ok, _ = state.CanValidateHeight(10)
+	assert.True(t, ok)
+}
+
+func TestStateWithConsensusParams(t *testing.T) {
+	state, _, _ := makeState(3, 2)
+	state.LastBlockHeight = 5
+	orig := state.Copy()
+
+	params := *types.DefaultConsensusParams()
+	params.Block.MaxBytes = 1024
+
+	newState, err := state.WithConsensusParams(params, 6)
+	require.NoError(t, err)
+	assert.Equal(t, params, newState.ConsensusParams)
+	assert.EqualValues(t, 6, newState.LastHeightConsensusParamsChanged)
+	// the params are copied
+	params.Validator.PubKeyTypes[0] = "mutated"
+	assert.Equal(t, types.ABCIPubKeyTypeEd25519, newState.ConsensusParams.Validator.PubKeyTypes[0])
+
+	// only the params changed
+	newState.ConsensusParams = state.ConsensusParams
+	newState.LastHeightConsensusParamsChanged = state.LastHeightConsensusParamsChanged
+	assert.True(t, state.Equals(newState))
+	assert.True(t, orig.Equals(state))
+
+	invalidParams := *types.DefaultConsensusParams()
+	invalidParams.Block.MaxBytes = 0
+	_, err = state.WithConsensusParams(invalidParams, 6)
+	assert.Error(t, err)
+	_, err = state.WithConsensusParams(*types.DefaultConsensusParams(), 7)
+	assert.Error(t, err)
+	_, err = state.WithConsensusParams(*types.DefaultConsensusParams(), 0)
+	assert.Error(t, err)
+}
+
 // TestABCIResponsesSaveLoad tests saving and loading ABCIResponses.
 func TestABCIResponsesSaveLoad1(t *testing.T) {
 	tearDown, stateDB, state := setupTestCase(t)
@@ -922,6 +1674,105 @@ func TestStateMakeBlock(t *testing.T) {
 	assert.Equal(t, proposerAddress, block.ProposerAddress)
 }
 
+func TestStateMakeBlockAt(t *testing.T) {
+	tearDown, _, state := setupTestCase(t)
+	defer tearDown(t)
+
+	proposerAddress := state.Validators.GetProposer().Address
+	commit := new(types.Commit)
+
+	// a time after the last block time is used as is
+	timestamp := state.LastBlockTime.Add(time.Minute)
+	block, partSet, err := state.MakeBlockAt(2, makeTxs(2), commit, nil, proposerAddress, timestamp)
+	require.NoError(t, err)
+	require.NotNil(t, partSet)
+	assert.True(t, timestamp.Equal(block.Time))
+	assert.EqualValues(t, 2, block.Height)
+	assert.Equal(t, proposerAddress, block.ProposerAddress)
+
+	// building the same block twice gives the same hash
+	block2, _, err := state.MakeBlockAt(2, makeTxs(2), commit, nil, proposerAddress, timestamp)
+	require.NoError(t, err)
+	assert.Equal(t, block.Hash(), block2.Hash())
+
+	// the last block time itself is allowed
+	block, _, err = state.MakeBlockAt(1, makeTxs(1), commit, nil, proposerAddress, state.LastBlockTime)
+	require.NoError(t, err)
+	assert.True(t, state.LastBlockTime.Equal(block.Time))
+
+	// a time before the last block time violates monotonicity
+	_, _, err = state.MakeBlockAt(2, makeTxs(2), commit, nil, proposerAddress, state.LastBlockTime.Add(-time.Second))
+	assert.Error(t, err)
+}
+
+func TestStateMakeBlockChecked(t *testing.T) {
+	tearDown, _, state := setupTestCase(t)
+	defer tearDown(t)
+
+	state.Validators = genValSet(3)
+	state.NextValidators = state.Validators.CopyIncrementProposerPriority(1)
+	proposerAddress := state.Validators.GetProposer().Address
+
+	block, partSet, err := state.MakeBlockChecked(1, makeTxs(1), new(types.Commit), nil, proposerAddress)
+	require.NoError(t, err)
+	require.NotNil(t, partSet)
+	assert.EqualValues(t, state.Validators.Hash(), block.ValidatorsHash)
+	assert.EqualValues(t, state.NextValidators.Hash(), block.NextValidatorsHash)
+
+	cases := []struct {
+		name    string
+		corrupt func(state *sm.State)
+	}{
+		{"empty validators", func(state *sm.State) {
+			state.Validators = types.NewValidatorSet(nil)
+		}},
+		{"zero power", func(state *sm.State) {
+			state.Validators.Validators[1].VotingPower = 0
+		}},
+		{"unsorted", func(state *sm.State) {
+			vals := state.NextValidators.Validators
+			vals[0], vals[2] = vals[2], vals[0]
+		}},
+		{"duplicate", func(state *sm.State) {
+			state.NextValidators.Validators[1] = state.NextValidators.Validators[0]
+		}},
+		{"address mismatch", func(state *sm.State) {
+			state.Validators.Validators[0].PubKey = ed25519.GenPrivKey().PubKey()
+		}},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			corrupted := state.Copy()
+			tc.corrupt(&corrupted)
+			_, _, err := corrupted.MakeBlockChecked(1, makeTxs(1), new(types.Commit), nil, proposerAddress)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestStateMakeBlockCheckedCommitHeight(t *testing.T) {
+	tearDown, _, state := setupTestCase(t)
+	defer tearDown(t)
+	proposerAddress := state.Validators.GetProposer().Address
+
+	// at the initial height, the commit must be empty
+	_, _, err := state.MakeBlockChecked(1, makeTxs(1), nil, nil, proposerAddress)
+	require.NoError(t, err)
+	sigs := []types.CommitSig{types.NewCommitSigAbsent()}
+	_, _, err = state.MakeBlockChecked(1, makeTxs(1), types.NewCommit(0, 0, types.BlockID{}, sigs), nil, proposerAddress)
+	assert.Error(t, err)
+
+	// afterwards, it must be for the previous height
+	_, _, err = state.MakeBlockChecked(3, makeTxs(3), types.NewCommit(2, 0, types.BlockID{}, nil), nil, proposerAddress)
+	require.NoError(t, err)
+	_, _, err = state.MakeBlockChecked(3, makeTxs(3), types.NewCommit(1, 0, types.BlockID{}, nil), nil, proposerAddress)
+	assert.Error(t, err)
+	_, _, err = state.MakeBlockChecked(3, makeTxs(3), nil, nil, proposerAddress)
+	assert.Error(t, err)
+}
+
 // TestConsensusParamsChangesSaveLoad tests saving and loading consensus params
 // with changes.
 func TestConsensusParamsChangesSaveLoad(t *testing.T) {
@@ -1019,3 +1870,266 @@ func TestApplyUpdates(t *testing.T) {
 		assert.Equal(t, tc.expected, res, "case %d", i)
 	}
 }
+
+func TestStateApplyConsensusParamUpdate(t *testing.T) {
+	tearDown, _, state := setupTestCase(t)
+	defer tearDown(t)
+
+	const atHeight int64 = 10
+	initParams := state.ConsensusParams
+	initChanged := state.LastHeightConsensusParamsChanged
+
+	blockParams := initParams
+	blockParams.Block.MaxBytes = 1024
+	blockParams.Block.MaxGas = 55
+
+	evidenceParams := initParams
+	evidenceParams.Evidence.MaxAgeNumBlocks = 66
+	evidenceParams.Evidence.MaxAgeDuration = 66 * time.Hour
+
+	cases := []struct {
+		name            string
+		update          *abci.ConsensusParams
+		expectedParams  types.ConsensusParams
+		expectedChanged int64
+		expectErr       bool
+	}{
+		{"nil update", nil, initParams, initChanged, false},
+		{"only block", &abci.ConsensusParams{
+			Block: &abci.BlockParams{MaxBytes: 1024, MaxGas: 55},
+		}, blockParams, atHeight + 1, false},
+		{"only evidence", &abci.ConsensusParams{
+			Evidence: &abci.EvidenceParams{MaxAgeNumBlocks: 66, MaxAgeDuration: 66 * time.Hour},
+		}, evidenceParams, atHeight + 1, false},
+		{"invalid block", &abci.ConsensusParams{
+			Block: &abci.BlockParams{MaxBytes: 0, MaxGas: 55},
+		}, initParams, initChanged, true},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			params, changed, err := state.ApplyConsensusParamUpdate(tc.update, atHeight)
+			if tc.expectErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.expectedParams, params)
+			assert.Equal(t, tc.expectedChanged, changed)
+			// the state itself must not be mutated
+			assert.Equal(t, initParams, state.ConsensusParams)
+		})
+	}
+}
+
+func TestUpdateStateMaxValidators(t *testing.T) {
+	tearDown, _, state := setupTestCase(t)
+	defer tearDown(t)
+
+	state.Validators = genValSet(1)
+	state.NextValidators = state.Validators
+	maxVals := sm.MaxValidators
+
+	block := makeBlock(state, state.LastBlockHeight+1)
+	blockID := types.BlockID{Hash: block.Hash(), PartsHeader: block.MakePartSet(testPartSize).Header()}
+	abciResponses := &sm.ABCIResponses{
+		EndBlock: &abci.ResponseEndBlock{ValidatorUpdates: nil},
+	}
+
+	// one validator is already in the set
+	newVals := make([]*types.Validator, maxVals)
+	for i := range newVals {
+		newVals[i] = types.NewValidator(ed25519.GenPrivKey().PubKey(), 10)
+	}
+
+	// at the limit
+	updatedState, err := sm.UpdateState(state, blockID, &block.Header, abciResponses, newVals[:maxVals-1])
+	require.NoError(t, err)
+	assert.Equal(t, maxVals, updatedState.NextValidators.Size())
+
+	// above the limit
+	_, err = sm.UpdateState(state, blockID, &block.Header, abciResponses, newVals)
+	assert.Error(t, err)
+	assert.Equal(t, 1, state.NextValidators.Size())
+}
+
+func TestStateScheduleConsensusParams(t *testing.T) {
+	tearDown, _, state := setupTestCase(t)
+	defer tearDown(t)
+
+	initParams := state.ConsensusParams
+	update := &abci.ConsensusParams{Block: &abci.BlockParams{MaxBytes: 1024, MaxGas: initParams.Block.MaxGas}}
+	nextHeight := state.LastBlockHeight + 1
+
+	// the next block's params are already fixed
+	_, err := state.ScheduleConsensusParams(nextHeight, update)
+	assert.Error(t, err)
+	// empty and invalid updates
+	_, err = state.ScheduleConsensusParams(nextHeight+2, nil)
+	assert.Error(t, err)
+	invalidUpdate := &abci.ConsensusParams{Block: &abci.BlockParams{MaxBytes: 0}}
+	_, err = state.ScheduleConsensusParams(nextHeight+2, invalidUpdate)
+	assert.Error(t, err)
+
+	scheduled, err := state.ScheduleConsensusParams(nextHeight+2, update)
+	require.NoError(t, err)
+	assert.Empty(t, state.PendingConsensusParams)
+	require.NoError(t, scheduled.ValidateBasic())
+	// the update is copied
+	update.Block.MaxBytes = 2048
+	assert.EqualValues(t, 1024, scheduled.PendingConsensusParams[0].Update.Block.MaxBytes)
+	update.Block.MaxBytes = 1024
+	// heights must be strictly increasing
+	_, err = scheduled.ScheduleConsensusParams(nextHeight+2, update)
+	assert.Error(t, err)
+
+	testCases := []struct {
+		name string
+		// height of the block whose EndBlock updates the evidence params
+		endBlockHeight int64
+	}{
+		{"no EndBlock update", 0},
+		{"EndBlock update before", nextHeight},
+		{"EndBlock update at the same height", nextHeight + 1},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			expectedParams := initParams
+			expectedParams.Block.MaxBytes = 1024
+			evidenceUpdate := &abci.ConsensusParams{Evidence: &abci.EvidenceParams{
+				MaxAgeNumBlocks: initParams.Evidence.MaxAgeNumBlocks + 1,
+				MaxAgeDuration:  initParams.Evidence.MaxAgeDuration,
+			}}
+			if tc.endBlockHeight > 0 {
+				expectedParams.Evidence.MaxAgeNumBlocks++
+			}
+
+			// the params take effect exactly at the scheduled height, without
+			// losing updates from EndBlock
+			state := scheduled
+			for height := nextHeight; height < nextHeight+3; height++ {
+				abciResponses := &sm.ABCIResponses{EndBlock: &abci.ResponseEndBlock{}}
+				if height == tc.endBlockHeight {
+					abciResponses.EndBlock.ConsensusParamUpdates = evidenceUpdate
+				}
+				block := makeBlock(state, height)
+				blockID := types.BlockID{Hash: block.Hash(), PartsHeader: block.MakePartSet(testPartSize).Header()}
+				state, err = sm.UpdateState(state, blockID, &block.Header, abciResponses, nil)
+				require.NoError(t, err)
+
+				if height+1 < nextHeight+2 {
+					assert.Equal(t, initParams.Block, state.ConsensusParams.Block, "height %d", height+1)
+					assert.Len(t, state.PendingConsensusParams, 1)
+				} else {
+					assert.Equal(t, expectedParams, state.ConsensusParams, "height %d", height+1)
+					assert.EqualValues(t, nextHeight+2, state.LastHeightConsensusParamsChanged)
+					assert.Empty(t, state.PendingConsensusParams)
+				}
+			}
+		})
+	}
+}
+
+// medianTimeReference is the original MedianTime implementation, which
+// allocates a WeightedTime for every signature.
+func medianTimeReference(commit *types.Commit, validators *types.ValidatorSet) time.Time {
+	weightedTimes := make([]*tmtime.WeightedTime, len(commit.Signatures))
+	totalVotingPower := int64(0)
+
+	for i, commitSig := range commit.Signatures {
+		if commitSig.Absent() {
+			continue
+		}
+		_, validator := validators.GetByAddress(commitSig.ValidatorAddress)
+		if validator != nil {
+			totalVotingPower += validator.VotingPower
+			weightedTimes[i] = tmtime.NewWeightedTime(commitSig.Timestamp, validator.VotingPower)
+		}
+	}
+
+	return tmtime.WeightedMedian(weightedTimes, totalVotingPower)
+}
+
+// randCommitForMedianTime returns a commit for the given validators where some
+// signatures are absent, some are from unknown validators and, if shuffle is
+// set, the signatures aren't in validator set order.
+func randCommitForMedianTime(vals *types.ValidatorSet, shuffle bool) *types.Commit {
+	now := tmtime.Now()
+	sigs := make([]types.CommitSig, vals.Size())
+	for i, val := range vals.Validators {
+		ts := now.Add(time.Duration(tmrand.Intn(10000)) * time.Millisecond)
+		switch r := tmrand.Intn(10); {
+		case r < 2:
+			sigs[i] = types.NewCommitSigAbsent()
+		case r < 3:
+			sigs[i] = types.NewCommitSigForBlock(nil, ed25519.GenPrivKey().PubKey().Address(), ts)
+		default:
+			sigs[i] = types.NewCommitSigForBlock(nil, val.Address, ts)
+		}
+	}
+	if shuffle {
+		for i := range sigs {
+			j := tmrand.Intn(i + 1)
+			sigs[i], sigs[j] = sigs[j], sigs[i]
+		}
+	}
+	return types.NewCommit(1, 0, types.BlockID{}, sigs)
+}
+
+func TestMedianTimeMatchesReference(t *testing.T) {
+	for i := 0; i < 200; i++ {
+		powers := make([]int64, tmrand.Intn(30)+1)
+		for j := range powers {
+			powers[j] = tmrand.Int63n(100) + 1
+		}
+		vals := genValSetWithPowers(powers)
+		commit := randCommitForMedianTime(vals, i%2 == 0)
+
+		expected := medianTimeReference(commit, vals)
+		assert.True(t, expected.Equal(sm.MedianTime(commit, vals)),
+			"median time mismatch (iteration %d)", i)
+	}
+}
+
+func TestMedianTimeChecked(t *testing.T) {
+	vals := genValSetWithPowers([]int64{10, 20, 30})
+	now := tmtime.Now()
+	sigs := make([]types.CommitSig, vals.Size())
+	for i, val := range vals.Validators {
+		sigs[i] = types.NewCommitSigForBlock(nil, val.Address, now.Add(time.Duration(i)*time.Second))
+	}
+	sigs[0] = types.NewCommitSigAbsent()
+	commit := types.NewCommit(1, 0, types.BlockID{}, sigs)
+
+	median, err := sm.MedianTimeChecked(commit, vals)
+	require.NoError(t, err)
+	assert.True(t, median.Equal(sm.MedianTime(commit, vals)))
+
+	// a signature of an unknown validator is reported, but ignored by MedianTime
+	unknownAddr := ed25519.GenPrivKey().PubKey().Address()
+	commit.Signatures[1] = types.NewCommitSigForBlock(nil, unknownAddr, now)
+	_, err = sm.MedianTimeChecked(commit, vals)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), unknownAddr.String())
+	}
+	assert.True(t, now.Add(2*time.Second).Equal(sm.MedianTime(commit, vals)))
+}
+
+func BenchmarkMedianTime1000(b *testing.B) {
+	vals, _ := types.RandValidatorSet(1000, 10)
+	now := tmtime.Now()
+	sigs := make([]types.CommitSig, vals.Size())
+	for i, val := range vals.Validators {
+		sigs[i] = types.NewCommitSigForBlock(nil, val.Address, now.Add(time.Duration(i)*time.Millisecond))
+	}
+	commit := types.NewCommit(1, 0, types.BlockID{}, sigs)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sm.MedianTime(commit, vals)
+	}
+}
@@ -35,7 +35,7 @@ func calcABCIResponsesKey(height int64) []byte {
 
 // LoadStateFromDBOrGenesisFile loads the most recent state from the database,
 // or creates a new one from the given genesisFilePath and persists the result
-// to the database.
+// to the database. A state loaded from the database must pass ValidateBasic.
 func LoadStateFromDBOrGenesisFile(stateDB dbm.DB, genesisFilePath string) (State, error) {
 	state := LoadState(stateDB)
 	if state.IsEmpty() {
@@ -45,6 +45,8 @@ func LoadStateFromDBOrGenesisFile(stateDB dbm.DB, genesisFilePath string) (State
 			return state, err
 		}
 		SaveState(stateDB, state)
+	} else if err := state.ValidateBasic(); err != nil {
+		return state, fmt.Errorf("invalid state loaded from database: %w", err)
 	}
 
 	return state, nil
@@ -52,7 +54,7 @@ func LoadStateFromDBOrGenesisFile(stateDB dbm.DB, genesisFilePath string) (State
 
 // LoadStateFromDBOrGenesisDoc loads the most recent state from the database,
 // or creates a new one from the given genesisDoc and persists the result
-// to the database.
+// to the database. A state loaded from the database must pass ValidateBasic.
 func LoadStateFromDBOrGenesisDoc(stateDB dbm.DB, genesisDoc *types.GenesisDoc) (State, error) {
 	state := LoadState(stateDB)
 	if state.IsEmpty() {
@@ -62,6 +64,8 @@ func LoadStateFromDBOrGenesisDoc(stateDB dbm.DB, genesisDoc *types.GenesisDoc) (
 			return state, err
 		}
 		SaveState(stateDB, state)
+	} else if err := state.ValidateBasic(); err != nil {
+		return state, fmt.Errorf("invalid state loaded from database: %w", err)
 	}
 
 	return state, nil
@@ -89,6 +93,13 @@ func loadState(db dbm.DB, key []byte) (state State) {
 	}
 	// TODO: ensure that buf is completely read.
 
+	// States stored before InitialHeight was added always started at 1.
+	if state.InitialHeight == 0 {
+		state.InitialHeight = 1
+	}
+	// Empty validator sets may be decoded as nil.
+	state.EnsureValidatorSets()
+
 	return state
 }
 
@@ -238,9 +249,17 @@ func (arz *ABCIResponses) Bytes() []byte {
 	return cdc.MustMarshalBinaryBare(arz)
 }
 
+// ResultsHash returns the merkle root of the DeliverTx results, as set in
+// State.LastResultsHash.
 func (arz *ABCIResponses) ResultsHash() []byte {
-	results := types.NewResults(arz.DeliverTxs)
-	return results.Hash()
+	return ComputeResultsHash(arz.DeliverTxs)
+}
+
+// ComputeResultsHash returns the merkle root of the deterministic components
+// (code and data) of the given DeliverTx responses. It is the canonical way of
+// computing the LastResultsHash of the next block.
+func ComputeResultsHash(deliverTxResponses []*abci.ResponseDeliverTx) []byte {
+	return types.NewResults(deliverTxResponses).Hash()
 }
 
 // LoadABCIResponses loads the ABCIResponses for the given height from the database.
@@ -320,6 +339,41 @@ func lastStoredHeightFor(height, lastHeightChanged int64) int64 {
 	return tmmath.MaxInt64(checkpointHeight, lastHeightChanged)
 }
 
+// MinRetainValidatorHeight returns the lowest height whose stored validator
+// set info must be kept for LoadValidators to return the validator sets of the
+// state, i.e. from LastBlockHeight on, and the validator sets evidence is
+// checked against. Older validator set infos can be pruned.
+// Evidence is only rejected once it's older than both
+// Evidence.MaxAgeNumBlocks and Evidence.MaxAgeDuration, so validator sets are
+// kept from the lower of LastBlockHeight - MaxAgeNumBlocks and
+// minEvidenceTimeHeight, the lowest height whose block time is still within
+// MaxAgeDuration of LastBlockTime. The state can't resolve the latter, so the
+// caller has to look it up in the block store.
+// A validator set is stored in full at the height it changed and at every
+// checkpoint; if a set changed at an unknown height (the state only knows the
+// last change of NextValidators), the preceding checkpoint is returned.
+func (state State) MinRetainValidatorHeight(minEvidenceTimeHeight int64) int64 {
+	height := state.LastBlockHeight
+	if height < state.InitialHeight {
+		return state.InitialHeight
+	}
+	minHeight := height - height%valSetCheckpointInterval
+	if state.LastHeightValidatorsChanged <= height {
+		minHeight = lastStoredHeightFor(height, state.LastHeightValidatorsChanged)
+	}
+
+	evidenceHeight := tmmath.MinInt64(height-state.ConsensusParams.Evidence.MaxAgeNumBlocks, minEvidenceTimeHeight)
+	if evidenceHeight < minHeight {
+		if state.LastHeightValidatorsChanged <= evidenceHeight {
+			minHeight = lastStoredHeightFor(evidenceHeight, state.LastHeightValidatorsChanged)
+		} else {
+			minHeight = evidenceHeight - evidenceHeight%valSetCheckpointInterval
+		}
+	}
+
+	return tmmath.MaxInt64(minHeight, state.InitialHeight)
+}
+
 // CONTRACT: Returned ValidatorsInfo can be mutated.
 func loadValidatorsInfo(db dbm.DB, height int64) *ValidatorsInfo {
 	buf, err := db.Get(calcValidatorsKey(height))
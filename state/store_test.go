@@ -1,6 +1,7 @@
 package state_test
 
 import (
+	"encoding/hex"
 	"fmt"
 	"os"
 	"testing"
@@ -10,7 +11,10 @@ import (
 
 	dbm "github.com/tendermint/tm-db"
 
+	abci "github.com/tendermint/tendermint/abci/types"
 	cfg "github.com/tendermint/tendermint/config"
+	"github.com/tendermint/tendermint/crypto/ed25519"
+	tmmath "github.com/tendermint/tendermint/libs/math"
 	sm "github.com/tendermint/tendermint/state"
 	"github.com/tendermint/tendermint/types"
 )
@@ -66,6 +70,98 @@ func BenchmarkLoadValidators(b *testing.B) {
 	}
 }
 
+func TestStateMinRetainValidatorHeight(t *testing.T) {
+	const interval = sm.ValSetCheckpointInterval
+	testCases := []struct {
+		name              string
+		lastBlockHeight   int64
+		lastHeightChanged int64
+		maxAgeNumBlocks   int64
+		minTimeHeight     int64
+		expected          int64
+	}{
+		{"genesis", 0, 1, 0, 0, 1},
+		{"never changed", 10, 1, 0, 10, 1},
+		{"changed before", 10, 5, 0, 10, 5},
+		{"changed at last height", 10, 10, 0, 10, 10},
+		{"pending change", 10, 12, 0, 10, 1},
+		{"checkpoint after change", interval + 10, 5, 0, interval + 10, interval},
+		{"change after checkpoint", interval + 10, interval + 5, 0, interval + 10, interval + 5},
+		{"pending change after checkpoint", interval + 10, interval + 12, 0, interval + 10, interval},
+		{"evidence after change", interval + 10, interval + 5, 3, interval + 10, interval + 5},
+		{"evidence before change", 2*interval + 10, 2*interval + 5, 20, 2*interval + 10, interval},
+		{"evidence before checkpoint", 2*interval + 10, 5, 20, 2*interval + 10, interval},
+		{"evidence before genesis", 10, 5, 20, 10, 1},
+		{"evidence within max age duration", 2*interval + 10, 2*interval + 5, 3, 2*interval - 10, interval},
+		{"evidence within max age num blocks", 2*interval + 10, 2*interval + 5, 20, 2*interval + 8, interval},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			state := sm.State{
+				InitialHeight:               1,
+				LastBlockHeight:             tc.lastBlockHeight,
+				LastHeightValidatorsChanged: tc.lastHeightChanged,
+			}
+			state.ConsensusParams.Evidence.MaxAgeNumBlocks = tc.maxAgeNumBlocks
+			assert.Equal(t, tc.expected, state.MinRetainValidatorHeight(tc.minTimeHeight))
+		})
+	}
+}
+
+// TestStateMinRetainValidatorHeightLoad tests that the validators of the state
+// and of heights evidence may still be submitted for can be loaded after
+// deleting the validator infos below MinRetainValidatorHeight.
+func TestStateMinRetainValidatorHeightLoad(t *testing.T) {
+	testCases := []struct {
+		name            string
+		maxAgeNumBlocks int64
+		minTimeHeight   int64
+		expected        int64
+	}{
+		{"evidence after change", 3, 10, 6},
+		{"evidence before change", 8, 10, 1},
+		{"evidence within max age duration", 3, 2, 1},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tearDown, stateDB, state := setupTestCase(t)
+			defer tearDown(t)
+			state.ConsensusParams.Evidence.MaxAgeNumBlocks = tc.maxAgeNumBlocks
+			sm.SaveState(stateDB, state)
+
+			pubKey := ed25519.GenPrivKey().PubKey()
+			for height := int64(1); height <= 10; height++ {
+				var valUpdates []*types.Validator
+				if height == 4 {
+					valUpdates = []*types.Validator{types.NewValidator(pubKey, 10)}
+				}
+				block := makeBlock(state, height)
+				blockID := types.BlockID{Hash: block.Hash(), PartsHeader: block.MakePartSet(testPartSize).Header()}
+				responses := &sm.ABCIResponses{EndBlock: &abci.ResponseEndBlock{}}
+				var err error
+				state, err = sm.UpdateState(state, blockID, &block.Header, responses, valUpdates)
+				require.NoError(t, err)
+				sm.SaveState(stateDB, state)
+			}
+			minHeight := state.MinRetainValidatorHeight(tc.minTimeHeight)
+			require.EqualValues(t, tc.expected, minHeight)
+
+			for height := int64(1); height < minHeight; height++ {
+				stateDB.Delete([]byte(fmt.Sprintf("validatorsKey:%v", height)))
+			}
+			evidenceHeight := tmmath.MinInt64(state.LastBlockHeight-tc.maxAgeNumBlocks, tc.minTimeHeight)
+			for height := evidenceHeight; height <= state.LastBlockHeight+2; height++ {
+				_, err := sm.LoadValidators(stateDB, height)
+				require.NoError(t, err, "height %d", height)
+			}
+		})
+	}
+}
+
 func TestPruneStates(t *testing.T) {
 	testcases := map[string]struct {
 		makeHeights  int64
@@ -175,6 +271,38 @@ func TestPruneStates(t *testing.T) {
 	}
 }
 
+func TestComputeResultsHash(t *testing.T) {
+	responses := []*abci.ResponseDeliverTx{
+		{Code: 0, Data: []byte("foo")},
+		{Code: 1, Data: []byte("bar"), Log: "failed"},
+		{Code: 0, Data: nil},
+	}
+	// Only the code and data of each response are part of the hash.
+	responsesWithExtras := []*abci.ResponseDeliverTx{
+		{Code: 0, Data: []byte("foo"), Log: "ok", GasUsed: 10},
+		{Code: 1, Data: []byte("bar"), Info: "info"},
+		{Code: 0, Data: nil, Events: []abci.Event{{Type: "transfer"}}},
+	}
+	reordered := []*abci.ResponseDeliverTx{responses[1], responses[0], responses[2]}
+
+	expected, err := hex.DecodeString("D306B629F331D6F713F96ED4923267D9B573C8B5ECD4729C8F8F2E12F4352D0D")
+	require.NoError(t, err)
+
+	hash := sm.ComputeResultsHash(responses)
+	assert.Equal(t, expected, hash)
+	assert.Equal(t, hash, sm.ComputeResultsHash(responsesWithExtras))
+	assert.Equal(t, hash, (&sm.ABCIResponses{DeliverTxs: responses}).ResultsHash())
+	assert.NotEqual(t, hash, sm.ComputeResultsHash(reordered))
+
+	state, _, _ := makeState(1, 1)
+	state.LastResultsHash = []byte("old")
+	newState := state.WithResultsHash(hash)
+	assert.Equal(t, hash, newState.LastResultsHash)
+	assert.Equal(t, []byte("old"), state.LastResultsHash)
+	newState.LastResultsHash = state.LastResultsHash
+	assert.True(t, state.Equals(newState))
+}
+
 func sliceToMap(s []int64) map[int64]bool {
 	m := make(map[int64]bool, len(s))
 	for _, i := range s {
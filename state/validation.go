@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"strings"
 
 	dbm "github.com/tendermint/tm-db"
 
 	"github.com/tendermint/tendermint/crypto"
+	tmbytes "github.com/tendermint/tendermint/libs/bytes"
 	"github.com/tendermint/tendermint/types"
+	"github.com/tendermint/tendermint/version"
 )
 
 //-----------------------------------------------------
@@ -21,11 +24,8 @@ func validateBlock(evidencePool EvidencePool, stateDB dbm.DB, state State, block
 	}
 
 	// Validate basic info.
-	if block.Version != state.Version.Consensus {
-		return fmt.Errorf("wrong Block.Header.Version. Expected %v, got %v",
-			state.Version.Consensus,
-			block.Version,
-		)
+	if err := state.ValidateBlockVersion(block.Version); err != nil {
+		return fmt.Errorf("wrong Block.Header.Version: %w", err)
 	}
 	if block.ChainID != state.ChainID {
 		return fmt.Errorf("wrong Block.Header.ChainID. Expected %v, got %v",
@@ -49,11 +49,9 @@ func validateBlock(evidencePool EvidencePool, stateDB dbm.DB, state State, block
 	}
 
 	// Validate app info
-	if !bytes.Equal(block.AppHash, state.AppHash) {
-		return fmt.Errorf("wrong Block.Header.AppHash.  Expected %X, got %v",
-			state.AppHash,
-			block.AppHash,
-		)
+	// block.AppHash is the app state after the previous block.
+	if err := CompareAppHash(state.AppHash, block.AppHash, block.Height-1); err != nil {
+		return fmt.Errorf("wrong Block.Header.AppHash: %w", err)
 	}
 	if !bytes.Equal(block.ConsensusHash, state.ConsensusParams.Hash()) {
 		return fmt.Errorf("wrong Block.Header.ConsensusHash.  Expected %X, got %v",
@@ -81,9 +79,9 @@ func validateBlock(evidencePool EvidencePool, stateDB dbm.DB, state State, block
 	}
 
 	// Validate block LastCommit.
-	if block.Height == 1 {
+	if block.Height == state.InitialHeight {
 		if len(block.LastCommit.Signatures) != 0 {
-			return errors.New("block at height 1 can't have LastCommit signatures")
+			return fmt.Errorf("block at initial height %d can't have LastCommit signatures", block.Height)
 		}
 	} else {
 		if len(block.LastCommit.Signatures) != state.LastValidators.Size() {
@@ -97,7 +95,7 @@ func validateBlock(evidencePool EvidencePool, stateDB dbm.DB, state State, block
 	}
 
 	// Validate block Time
-	if block.Height > 1 {
+	if block.Height > state.InitialHeight {
 		if !block.Time.After(state.LastBlockTime) {
 			return fmt.Errorf("block time %v not greater than last block time %v",
 				block.Time,
@@ -112,7 +110,7 @@ func validateBlock(evidencePool EvidencePool, stateDB dbm.DB, state State, block
 				block.Time,
 			)
 		}
-	} else if block.Height == 1 {
+	} else if block.Height == state.InitialHeight {
 		genesisTime := state.LastBlockTime
 		if !block.Time.Equal(genesisTime) {
 			return fmt.Errorf("block time %v is not equal to genesis time %v",
@@ -153,6 +151,89 @@ func validateBlock(evidencePool EvidencePool, stateDB dbm.DB, state State, block
 	return nil
 }
 
+// ValidateBlockVersion checks that the consensus version declared by a block
+// matches the block and app protocol versions the state expects.
+func (state State) ValidateBlockVersion(blockVersion version.Consensus) error {
+	expected := state.Version.Consensus
+	if blockVersion.Block != expected.Block {
+		return fmt.Errorf("block protocol version mismatch: expected %d, got %d",
+			expected.Block,
+			blockVersion.Block,
+		)
+	}
+	if blockVersion.App != expected.App {
+		return fmt.Errorf("app protocol version mismatch: expected %d, got %d",
+			expected.App,
+			blockVersion.App,
+		)
+	}
+	return nil
+}
+
+// AssertMatchesBlock checks that the header fields of block which derive from
+// the state match it, i.e. that block is the next block built on the state.
+// Unlike validateBlock, it doesn't stop at the first mismatch: the returned
+// error lists every mismatching field with the expected and actual values. It
+// is meant for replay tooling.
+func (state State) AssertMatchesBlock(block *types.Block) error {
+	var diffs []string
+	diff := func(field string, expected, actual interface{}) {
+		diffs = append(diffs, fmt.Sprintf("%s: expected %v, got %v", field, expected, actual))
+	}
+
+	if block.Version != state.Version.Consensus {
+		diff("Version", state.Version.Consensus, block.Version)
+	}
+	if block.ChainID != state.ChainID {
+		diff("ChainID", state.ChainID, block.ChainID)
+	}
+	if block.Height != state.LastBlockHeight+1 {
+		diff("Height", state.LastBlockHeight+1, block.Height)
+	}
+	if !block.LastBlockID.Equals(state.LastBlockID) {
+		diff("LastBlockID", state.LastBlockID, block.LastBlockID)
+	}
+	if hash := state.Validators.Hash(); !bytes.Equal(block.ValidatorsHash, hash) {
+		diff("ValidatorsHash", tmbytes.HexBytes(hash), block.ValidatorsHash)
+	}
+	if hash := state.NextValidators.Hash(); !bytes.Equal(block.NextValidatorsHash, hash) {
+		diff("NextValidatorsHash", tmbytes.HexBytes(hash), block.NextValidatorsHash)
+	}
+	if hash := state.ConsensusParams.Hash(); !bytes.Equal(block.ConsensusHash, hash) {
+		diff("ConsensusHash", tmbytes.HexBytes(hash), block.ConsensusHash)
+	}
+	if !bytes.Equal(block.AppHash, state.AppHash) {
+		diff("AppHash", tmbytes.HexBytes(state.AppHash), block.AppHash)
+	}
+	if !bytes.Equal(block.LastResultsHash, state.LastResultsHash) {
+		diff("LastResultsHash", tmbytes.HexBytes(state.LastResultsHash), block.LastResultsHash)
+	}
+
+	if len(diffs) > 0 {
+		return fmt.Errorf("block %d doesn't match state at height %d: %s",
+			block.Height,
+			state.LastBlockHeight,
+			strings.Join(diffs, "; "),
+		)
+	}
+	return nil
+}
+
+// CompareAppHash returns an ErrAppHashMismatch describing both hashes if the
+// expected and actual app hashes at the given height differ, and nil otherwise.
+// The height is the one of the last block executed by the app to produce the
+// hash, i.e. block.Height-1 for block.AppHash.
+func CompareAppHash(expected, actual []byte, height int64) error {
+	if !bytes.Equal(expected, actual) {
+		return ErrAppHashMismatch{
+			Height:   height,
+			Expected: expected,
+			Actual:   actual,
+		}
+	}
+	return nil
+}
+
 // VerifyEvidence verifies the evidence fully by checking:
 // - it is sufficiently recent (MaxAge)
 // - it is from a key who was a validator at the given height
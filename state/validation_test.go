@@ -1,6 +1,8 @@
 package state_test
 
 import (
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 
@@ -13,6 +15,7 @@ import (
 	sm "github.com/tendermint/tendermint/state"
 	"github.com/tendermint/tendermint/types"
 	tmtime "github.com/tendermint/tendermint/types/time"
+	"github.com/tendermint/tendermint/version"
 )
 
 const validationTestsStopHeight int64 = 10
@@ -87,6 +90,124 @@ func TestValidateBlockHeader(t *testing.T) {
 	}
 }
 
+func TestCompareAppHash(t *testing.T) {
+	hash := tmhash.Sum([]byte("app hash"))
+	otherHash := tmhash.Sum([]byte("other app hash"))
+
+	testCases := []struct {
+		name     string
+		expected []byte
+		actual   []byte
+		wantErr  bool
+	}{
+		{"matching", hash, hash, false},
+		{"both empty", nil, []byte{}, false},
+		{"length mismatch", hash, hash[:20], true},
+		{"value mismatch", hash, otherHash, true},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := sm.CompareAppHash(tc.expected, tc.actual, 7)
+			if !tc.wantErr {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			mismatch, ok := err.(sm.ErrAppHashMismatch)
+			require.True(t, ok, "expected ErrAppHashMismatch, got %T", err)
+			require.EqualValues(t, 7, mismatch.Height)
+			require.Equal(t, tc.expected, mismatch.Expected)
+			require.Equal(t, tc.actual, mismatch.Actual)
+			require.Contains(t, err.Error(), fmt.Sprintf("%X (%d bytes)", tc.actual, len(tc.actual)))
+		})
+	}
+}
+
+// TestValidateBlockAppHashHeight tests that an app hash mismatch in a block
+// is reported at the height of the state, i.e. the height the app hash is from.
+func TestValidateBlockAppHashHeight(t *testing.T) {
+	proxyApp := newTestApp()
+	require.NoError(t, proxyApp.Start())
+	defer proxyApp.Stop()
+
+	state, stateDB, privVals := makeState(1, 1)
+	blockExec := sm.NewBlockExecutor(
+		stateDB,
+		log.TestingLogger(),
+		proxyApp.Consensus(),
+		mock.Mempool{},
+		sm.MockEvidencePool{},
+	)
+	lastCommit := types.NewCommit(0, 0, types.BlockID{}, nil)
+	proposerAddr := state.Validators.GetProposer().Address
+	state, _, lastCommit, err := makeAndCommitGoodBlock(state, 1, lastCommit, proposerAddr, blockExec, privVals, nil)
+	require.NoError(t, err)
+
+	block, _ := state.MakeBlock(2, makeTxs(2), lastCommit, nil, proposerAddr)
+	block.AppHash = tmhash.Sum([]byte("this hash is wrong"))
+	err = blockExec.ValidateBlock(state, block)
+	require.Error(t, err)
+	var mismatch sm.ErrAppHashMismatch
+	require.True(t, errors.As(err, &mismatch), "expected ErrAppHashMismatch, got %v", err)
+	require.EqualValues(t, 1, mismatch.Height)
+	require.Equal(t, state.LastBlockHeight, mismatch.Height)
+}
+
+func TestStateValidateBlockVersion(t *testing.T) {
+	state, _, _ := makeState(1, 1)
+	state.Version.Consensus.App = 2
+	expected := state.Version.Consensus
+
+	testCases := []struct {
+		name    string
+		version version.Consensus
+		errMsg  string
+	}{
+		{"matching", expected, ""},
+		{"block version mismatch", version.Consensus{Block: expected.Block + 1, App: expected.App},
+			"block protocol version mismatch"},
+		{"app version mismatch", version.Consensus{Block: expected.Block, App: expected.App - 1},
+			"app protocol version mismatch"},
+		{"empty", version.Consensus{}, "block protocol version mismatch"},
+	}
+
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			err := state.ValidateBlockVersion(tc.version)
+			if tc.errMsg == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.errMsg)
+		})
+	}
+}
+
+func TestStateAssertMatchesBlock(t *testing.T) {
+	state, _, _ := makeState(3, 1)
+	block := makeBlock(state, state.LastBlockHeight+1)
+	require.NoError(t, state.AssertMatchesBlock(block))
+
+	wrongHash := tmhash.Sum([]byte("this hash is wrong"))
+	block.AppHash = wrongHash
+	block.ValidatorsHash = wrongHash
+	err := state.AssertMatchesBlock(block)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), fmt.Sprintf("AppHash: expected %X, got %X", state.AppHash, wrongHash))
+	require.Contains(t, err.Error(),
+		fmt.Sprintf("ValidatorsHash: expected %X, got %X", state.Validators.Hash(), wrongHash))
+	require.NotContains(t, err.Error(), "NextValidatorsHash")
+
+	block = makeBlock(state, state.LastBlockHeight+2)
+	err = state.AssertMatchesBlock(block)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Height")
+}
+
 func TestValidateBlockCommit(t *testing.T) {
 	proxyApp := newTestApp()
 	require.NoError(t, proxyApp.Start())
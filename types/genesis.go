@@ -12,7 +12,6 @@ import (
 	"github.com/tendermint/tendermint/crypto"
 	tmbytes "github.com/tendermint/tendermint/libs/bytes"
 	tmos "github.com/tendermint/tendermint/libs/os"
-	tmtime "github.com/tendermint/tendermint/types/time"
 )
 
 const (
@@ -64,7 +63,8 @@ func (genDoc *GenesisDoc) ValidatorHash() []byte {
 }
 
 // ValidateAndComplete checks that all necessary fields are present
-// and fills in defaults for optional fields left empty
+// and fills in defaults for optional fields left empty. The genesis time
+// is required.
 func (genDoc *GenesisDoc) ValidateAndComplete() error {
 	if genDoc.ChainID == "" {
 		return errors.New("genesis doc must include non-empty chain_id")
@@ -73,6 +73,12 @@ func (genDoc *GenesisDoc) ValidateAndComplete() error {
 		return errors.Errorf("chain_id in genesis doc is too long (max: %d)", MaxChainIDLen)
 	}
 
+	// The genesis time isn't defaulted: each node would default it to its own
+	// current time and they'd disagree on the genesis block time.
+	if genDoc.GenesisTime.IsZero() {
+		return errors.New("genesis doc must include genesis_time")
+	}
+
 	if genDoc.ConsensusParams == nil {
 		genDoc.ConsensusParams = DefaultConsensusParams()
 	} else if err := genDoc.ConsensusParams.Validate(); err != nil {
@@ -91,10 +97,6 @@ func (genDoc *GenesisDoc) ValidateAndComplete() error {
 		}
 	}
 
-	if genDoc.GenesisTime.IsZero() {
-		genDoc.GenesisTime = tmtime.Now()
-	}
-
 	return nil
 }
 
@@ -47,6 +47,22 @@ func TestGenesisBad(t *testing.T) {
 				`},"power":"10","name":""}` +
 				`]}`,
 		),
+		// missing genesis_time
+		[]byte(
+			`{"chain_id":"mychain", "validators":[` +
+				`{"pub_key":{` +
+				`"type":"tendermint/PubKeyEd25519","value":"AT/+aaL1eB0477Mud9JMm8Sh8BIvOYlPGC9KkIUmFaE="` +
+				`},"power":"10","name":""}` +
+				`]}`,
+		),
+		// zero genesis_time
+		[]byte(
+			`{"genesis_time":"0001-01-01T00:00:00Z","chain_id":"mychain", "validators":[` +
+				`{"pub_key":{` +
+				`"type":"tendermint/PubKeyEd25519","value":"AT/+aaL1eB0477Mud9JMm8Sh8BIvOYlPGC9KkIUmFaE="` +
+				`},"power":"10","name":""}` +
+				`]}`,
+		),
 	}
 
 	for _, testCase := range testCases {
@@ -58,7 +74,7 @@ func TestGenesisBad(t *testing.T) {
 func TestGenesisGood(t *testing.T) {
 	// test a good one by raw json
 	genDocBytes := []byte(
-		`{"genesis_time":"0001-01-01T00:00:00Z","chain_id":"test-chain-QDKdJr","consensus_params":null,"validators":[` +
+		`{"genesis_time":"2020-05-01T12:00:00Z","chain_id":"test-chain-QDKdJr","consensus_params":null,"validators":[` +
 			`{"pub_key":{` +
 			`"type":"tendermint/PubKeyEd25519","value":"AT/+aaL1eB0477Mud9JMm8Sh8BIvOYlPGC9KkIUmFaE="` +
 			`},"power":"10","name":""}` +
@@ -70,8 +86,9 @@ func TestGenesisGood(t *testing.T) {
 	pubkey := ed25519.GenPrivKey().PubKey()
 	// create a base gendoc from struct
 	baseGenDoc := &GenesisDoc{
-		ChainID:    "abc",
-		Validators: []GenesisValidator{{pubkey.Address(), pubkey, 10, "myval"}},
+		GenesisTime: tmtime.Now(),
+		ChainID:     "abc",
+		Validators:  []GenesisValidator{{pubkey.Address(), pubkey, 10, "myval"}},
 	}
 	genDocBytes, err = cdc.MarshalJSON(baseGenDoc)
 	assert.NoError(t, err, "error marshalling genDoc")
@@ -99,10 +116,10 @@ func TestGenesisGood(t *testing.T) {
 
 	// Genesis doc from raw json
 	missingValidatorsTestCases := [][]byte{
-		[]byte(`{"chain_id":"mychain"}`),                   // missing validators
-		[]byte(`{"chain_id":"mychain","validators":[]}`),   // missing validators
-		[]byte(`{"chain_id":"mychain","validators":null}`), // nil validator
-		[]byte(`{"chain_id":"mychain"}`),                   // missing validators
+		[]byte(`{"genesis_time":"2020-05-01T12:00:00Z","chain_id":"mychain"}`),                   // missing validators
+		[]byte(`{"genesis_time":"2020-05-01T12:00:00Z","chain_id":"mychain","validators":[]}`),   // missing validators
+		[]byte(`{"genesis_time":"2020-05-01T12:00:00Z","chain_id":"mychain","validators":null}`), // nil validator
+		[]byte(`{"genesis_time":"2020-05-01T12:00:00Z","chain_id":"mychain"}`),                   // missing validators
 	}
 
 	for _, tc := range missingValidatorsTestCases {